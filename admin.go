@@ -0,0 +1,190 @@
+package captain
+
+import (
+  "github.com/armadanet/captain/dockercntrl"
+  "github.com/gorilla/mux"
+  "github.com/google/uuid"
+  "encoding/json"
+  "net/http"
+  "net"
+  "log"
+  "os"
+  "path/filepath"
+  "strings"
+  "context"
+)
+
+const (
+  // Where the admin API is served unless told otherwise: a unix socket
+  // in a directory the host bind-mounts, since the captain runs in a
+  // container whose loopback the host cannot reach.
+  AdminAddress = "unix:/run/captain/admin.sock"
+)
+
+// StorageStatus describes the captain's cargo storage container.
+type StorageStatus struct {
+  ContainerID string  `json:"container_id,omitempty"`
+  Running     bool    `json:"running"`
+}
+
+// SpinnerStatus describes the captain's connection to its spinner.
+type SpinnerStatus struct {
+  URL       string  `json:"url,omitempty"`
+  Connected bool    `json:"connected"`
+}
+
+// ServeAdmin serves the admin API at addr, either host:port or
+// unix:<path>, until the captain shuts down. The API lets whoever runs
+// the machine see and control what the captain is running:
+//   GET  /node                  the machine's NodeStatus
+//   GET  /tasks                 every task record
+//   GET  /tasks/{id}            a task record
+//   GET  /tasks/{id}/logs       the output of a task's container
+//   POST /tasks/{id}/{action}   cancel, kill or remove a task
+//   GET  /storage               the cargo container's StorageStatus
+//   GET  /spinner               the SpinnerStatus of the connection
+//   GET  /metrics               metrics in the Prometheus text format
+func (c *Captain) ServeAdmin(addr string) error {
+  network, address := "tcp", addr
+  if strings.HasPrefix(addr, "unix:") {
+    network, address = "unix", strings.TrimPrefix(addr, "unix:")
+    if err := os.MkdirAll(filepath.Dir(address), 0700); err != nil {return err}
+    // a socket left by a previous captain blocks the listen
+    os.Remove(address)
+  }
+  listener, err := net.Listen(network, address)
+  if err != nil {return err}
+  if network == "unix" {
+    if err := os.Chmod(address, 0600); err != nil {
+      listener.Close()
+      return err
+    }
+  }
+  server := &http.Server{Handler: c.AdminHandler()}
+  go func() {
+    <- c.exit
+    server.Shutdown(context.Background())
+  }()
+  go func() {
+    if err := server.Serve(listener); err != http.ErrServerClosed {log.Println(err)}
+  }()
+  log.Println("Serving admin API at", addr)
+  return nil
+}
+
+// AdminHandler returns the handler behind ServeAdmin.
+func (c *Captain) AdminHandler() http.Handler {
+  router := mux.NewRouter().StrictSlash(true)
+  router.HandleFunc("/node", func(w http.ResponseWriter, r *http.Request) {
+    writeJSON(w, http.StatusOK, c.Status())
+  }).Methods(http.MethodGet)
+  router.HandleFunc("/tasks", func(w http.ResponseWriter, r *http.Request) {
+    writeJSON(w, http.StatusOK, c.tasks.List())
+  }).Methods(http.MethodGet)
+  router.HandleFunc("/tasks/{id}", func(w http.ResponseWriter, r *http.Request) {
+    id, ok := taskId(w, r)
+    if !ok {return}
+    task, found := c.tasks.Get(id)
+    if !found {
+      writeError(w, http.StatusNotFound, "No such task: " + id.String())
+      return
+    }
+    writeJSON(w, http.StatusOK, task)
+  }).Methods(http.MethodGet)
+  router.HandleFunc("/tasks/{id}/logs", func(w http.ResponseWriter, r *http.Request) {
+    id, ok := taskId(w, r)
+    if !ok {return}
+    container, err := c.container(id)
+    if err != nil {
+      writeError(w, errorStatus(err), err.Error())
+      return
+    }
+    logs, err := c.state.Logs(container)
+    if err != nil {
+      writeError(w, http.StatusInternalServerError, err.Error())
+      return
+    }
+    writeJSON(w, http.StatusOK, logs)
+  }).Methods(http.MethodGet)
+  router.HandleFunc("/tasks/{id}/{action}", func(w http.ResponseWriter, r *http.Request) {
+    id, ok := taskId(w, r)
+    if !ok {return}
+    message := &Message{Action: mux.Vars(r)["action"], Config: &dockercntrl.Config{Id: id}}
+    err := c.command(message)
+    ack := &CommandAck{Action: message.Action, Ok: err == nil}
+    status := http.StatusOK
+    if err != nil {
+      log.Println(err)
+      ack.Error = err.Error()
+      status = errorStatus(err)
+    }
+    writeJSON(w, status, ack)
+  }).Methods(http.MethodPost)
+  router.HandleFunc("/storage", func(w http.ResponseWriter, r *http.Request) {
+    writeJSON(w, http.StatusOK, c.storageStatus())
+  }).Methods(http.MethodGet)
+  router.HandleFunc("/spinner", func(w http.ResponseWriter, r *http.Request) {
+    writeJSON(w, http.StatusOK, c.spinnerStatus())
+  }).Methods(http.MethodGet)
+  router.HandleFunc("/metrics", c.serveMetrics).Methods(http.MethodGet)
+  return router
+}
+
+// Reads the task id of a request, answering it if the id is invalid.
+func taskId(w http.ResponseWriter, r *http.Request) (*uuid.UUID, bool) {
+  id, err := uuid.Parse(mux.Vars(r)["id"])
+  if err != nil {
+    writeError(w, http.StatusBadRequest, "Invalid task id: " + err.Error())
+    return nil, false
+  }
+  return &id, true
+}
+
+// Returns the http status answering a request that failed with err:
+// an unknown task is not found, an unknown action a bad request, and
+// anything else the captain's own failure.
+func errorStatus(err error) int {
+  switch err.(type) {
+  case *dockercntrl.NoContainer:
+    return http.StatusNotFound
+  case *UnknownAction:
+    return http.StatusBadRequest
+  }
+  return http.StatusInternalServerError
+}
+
+func writeJSON(w http.ResponseWriter, status int, data interface{}) {
+  w.Header().Set("Content-Type", "application/json")
+  w.WriteHeader(status)
+  if err := json.NewEncoder(w).Encode(data); err != nil {log.Println(err)}
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+  writeJSON(w, status, map[string]string{"error": message})
+}
+
+// Reports on the cargo storage container, if the captain started one.
+func (c *Captain) storageStatus() *StorageStatus {
+  status := &StorageStatus{}
+  c.mu.Lock()
+  for _, container := range c.system {
+    if container.Configuration != nil && container.Configuration.Storage {status.ContainerID = container.ID}
+  }
+  c.mu.Unlock()
+  if status.ContainerID == "" {return status}
+  inspection, err := c.state.Inspect(&dockercntrl.Container{ID: status.ContainerID})
+  if err != nil {
+    log.Println(err)
+    return status
+  }
+  status.Running = inspection.Running
+  return status
+}
+
+// Reports on the connection to the spinner.
+func (c *Captain) spinnerStatus() *SpinnerStatus {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  if c.link == nil {return &SpinnerStatus{}}
+  return &SpinnerStatus{URL: c.link.url, Connected: c.link.alive()}
+}
@@ -0,0 +1,153 @@
+package captain
+
+import (
+  "github.com/armadanet/captain/dockercntrl"
+  "github.com/google/uuid"
+  "fmt"
+  "sync"
+)
+
+const (
+  nanoCPUs = 1e9
+  // Limits given to tasks that declare none for a resource the
+  // volunteer caps, at most the whole contribution.
+  DefaultTaskCPUs   = 1.0
+  DefaultTaskMemory = 512 << 20
+)
+
+// Contribution is the share of the machine a volunteer offers to
+// Armada. Zero values contribute everything the docker host has.
+type Contribution struct {
+  CPUs    float64   `json:"cpus"`
+  Memory  int64     `json:"memory"` // bytes
+}
+
+// ResourceShortage is the Data of an InsufficientResources response,
+// comparing what a task asked for with what the captain had left.
+type ResourceShortage struct {
+  RequestedCPUs   float64   `json:"requested_cpus"`
+  AvailableCPUs   float64   `json:"available_cpus"`
+  RequestedMemory int64     `json:"requested_memory"`
+  AvailableMemory int64     `json:"available_memory"`
+}
+
+func (r *ResourceShortage) Error() string {
+  return fmt.Sprintf("Insufficient resources: requested %.2f CPUs and %d bytes, %.2f CPUs and %d bytes available",
+    r.RequestedCPUs, r.RequestedMemory, r.AvailableCPUs, r.AvailableMemory)
+}
+
+// usage is the share of the machine held by one task.
+type usage struct {
+  nanoCPUs  int64
+  memory    int64
+}
+
+// Admission decides whether the captain has room for a task. The sum
+// of the limits of admitted tasks is held under the lesser of the host
+// capacity and the volunteer's contribution. Only declared limits
+// (Limits.NanoCPUs and Limits.Memory) are counted, so while a resource
+// is capped by the contribution, tasks declaring no limit for it are
+// given a default one.
+type Admission struct {
+  mu            sync.Mutex
+  state         dockercntrl.Runtime
+  contribution  Contribution
+  capacity      *usage
+  used          map[uuid.UUID]usage
+}
+
+// Construct an admission controller for the given runtime's host
+func NewAdmission(state dockercntrl.Runtime, contribution Contribution) *Admission {
+  return &Admission{
+    state: state,
+    contribution: contribution,
+    used: make(map[uuid.UUID]usage),
+  }
+}
+
+// Returns the ceiling for admitted tasks, reading the host capacity
+// the first time it is needed.
+func (a *Admission) ceiling() (*usage, error) {
+  if a.capacity != nil {return a.capacity, nil}
+  info, err := a.state.Info()
+  if err != nil {return nil, err}
+  capacity := &usage{nanoCPUs: int64(info.NCPU) * nanoCPUs, memory: info.MemTotal}
+  if cpus := int64(a.contribution.CPUs * nanoCPUs); cpus > 0 && cpus < capacity.nanoCPUs {
+    capacity.nanoCPUs = cpus
+  }
+  if a.contribution.Memory > 0 && a.contribution.Memory < capacity.memory {
+    capacity.memory = a.contribution.Memory
+  }
+  a.capacity = capacity
+  return capacity, nil
+}
+
+// Admit reserves room for a task, or returns a *ResourceShortage if
+// the task would overcommit the captain. Configs without an id, the
+// captain's own system containers, are always admitted. Tasks with
+// invalid limits are refused before anything is reserved. A task
+// missing a limit for a contributed resource has the default limit set
+// in its config.
+func (a *Admission) Admit(config *dockercntrl.Config) error {
+  if config.Id == nil {return nil}
+  if err := config.Limits.Validate(); err != nil {return err}
+  a.mu.Lock()
+  defer a.mu.Unlock()
+  capacity, err := a.ceiling()
+  if err != nil {return err}
+  limits := dockercntrl.Limits{}
+  if config.Limits != nil {limits = *config.Limits}
+  defaulted := false
+  if a.contribution.CPUs > 0 && limits.NanoCPUs == 0 {
+    limits.NanoCPUs = smaller(int64(DefaultTaskCPUs * nanoCPUs), capacity.nanoCPUs)
+    defaulted = true
+  }
+  if a.contribution.Memory > 0 && limits.Memory == 0 {
+    limits.Memory = smaller(DefaultTaskMemory, capacity.memory)
+    defaulted = true
+  }
+  request := usage{nanoCPUs: limits.NanoCPUs, memory: limits.Memory}
+  available := *capacity
+  for _, u := range a.used {
+    available.nanoCPUs -= u.nanoCPUs
+    available.memory -= u.memory
+  }
+  if request.nanoCPUs > available.nanoCPUs || request.memory > available.memory {
+    return &ResourceShortage{
+      RequestedCPUs: float64(request.nanoCPUs) / nanoCPUs,
+      AvailableCPUs: float64(available.nanoCPUs) / nanoCPUs,
+      RequestedMemory: request.memory,
+      AvailableMemory: available.memory,
+    }
+  }
+  a.used[*config.Id] = request
+  if defaulted {config.Limits = &limits}
+  return nil
+}
+
+func smaller(a, b int64) int64 {
+  if a < b {return a}
+  return b
+}
+
+// Returns the ceiling for admitted tasks and how much of it they hold.
+func (a *Admission) load() (usage, usage, error) {
+  a.mu.Lock()
+  defer a.mu.Unlock()
+  capacity, err := a.ceiling()
+  if err != nil {return usage{}, usage{}, err}
+  var used usage
+  for _, u := range a.used {
+    used.nanoCPUs += u.nanoCPUs
+    used.memory += u.memory
+  }
+  return *capacity, used, nil
+}
+
+// Release returns the room held by a task.
+func (a *Admission) Release(id *uuid.UUID) {
+  if id == nil {return}
+  a.mu.Lock()
+  defer a.mu.Unlock()
+  delete(a.used, *id)
+}
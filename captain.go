@@ -7,31 +7,77 @@ import (
   "github.com/armadanet/spinner/spinresp"
   "github.com/armadanet/comms"
   "fmt"
+  "errors"
+  "context"
+  "sync"
+  "time"
 )
 
 // Captain holds state information and an exit mechanism.
 type Captain struct {
-  state   *dockercntrl.State
-  exit    chan interface{}
-  storage bool
-  name    string
+  state       dockercntrl.Runtime
+  tasks       *Registry
+  metrics     *metrics
+  admission   *Admission
+  imageBudget int64
+  retention   Retention
+  reap        chan struct{}     // signals the reaper that a task finished
+  exit        chan interface{}  // closed once the captain starts shutting down
+  stopped     chan interface{}  // closed once nothing more is sent to the spinner
+  write       chan interface{}
+  inflight    sync.WaitGroup
+  mu          sync.Mutex
+  system      []*dockercntrl.Container
+  link        *link             // the current link to the spinner, if any
+  storage     bool
+  name        string
+  started     time.Time
+  beaconURL   string
+  selfSpin    bool
+  bridge      string
+  overlay     string
 }
 
-// Constructs a new captain.
-func New(name string) (*Captain, error) {
-  state, err := dockercntrl.New()
-  if err != nil {return nil, err}
+// Constructs a new captain on top of the given container runtime,
+// normally a *dockercntrl.State.
+func New(name string, state dockercntrl.Runtime) (*Captain, error) {
+  if state == nil {return nil, errors.New("No runtime given")}
   return &Captain{
     state: state,
+    tasks: NewRegistry(),
+    metrics: newMetrics(),
+    admission: NewAdmission(state, Contribution{}),
+    exit: make(chan interface{}),
+    stopped: make(chan interface{}),
+    reap: make(chan struct{}, 1),
+    write: make(chan interface{}),
     storage: false,
     name: name,
+    started: time.Now(),
   }, nil
 }
 
-// Connects to a given spinner and runs an infinite loop.
-// This loop is because the dial runs a goroutine, which
-// stops if the main thread closes.
-func (c *Captain) Run(beaconURL string, selfSpin bool) {
+// Connects to a given spinner and serves it until the context is
+// cancelled. The dial runs goroutines, so Run blocks to keep them
+// alive, then shuts the captain down before returning.
+func (c *Captain) Run(ctx context.Context, beaconURL string, selfSpin bool) {
+  c.beaconURL = beaconURL
+  c.selfSpin = selfSpin
+  defer c.shutdown()
+  // stop waiting on the beacon or a self-spun spinner once cancelled
+  go func() {
+    select {
+    case <- ctx.Done():
+      c.stop()
+    case <- c.exit:
+    }
+  }()
+  // pick up task containers left from a previous run
+  if err := c.tasks.Reconcile(c.state); err != nil {
+    log.Println(err)
+  }
+  // remove the containers of finished tasks as they expire
+  go c.reaper()
   // create local bridge network
   bridge, err := c.state.GetNetwork()
   if err != nil {
@@ -44,6 +90,7 @@ func (c *Captain) Run(beaconURL string, selfSpin bool) {
     log.Println(err)
     return
   }
+  c.bridge = bridge.ID
   // start cargo container
   c.ConnectStorage()
   // query beacon for a spinner
@@ -53,17 +100,46 @@ func (c *Captain) Run(beaconURL string, selfSpin bool) {
     return
   }
   // Register to selected spinner and start acting as a worker
-  err = c.Dial("ws://"+spinner_name+":5912/join")
+  err = c.Dial(spinnerURL(spinner_name))
   if err != nil {
     log.Println(err)
     return
   }
   // exit
   select {
-  case <- c.exit:
+  case <- ctx.Done():
   }
 }
 
+// SetContribution caps the share of the machine given to tasks.
+// It should be called before the captain is run.
+func (c *Captain) SetContribution(contribution Contribution) {
+  c.admission = NewAdmission(c.state, contribution)
+}
+
+// SetImageBudget caps the disk used by images the captain pulled at
+// budget bytes. Least recently used images are removed after each task
+// to stay within it; zero leaves the cache unbounded.
+func (c *Captain) SetImageBudget(budget int64) {
+  c.imageBudget = budget
+}
+
+// Removes unused images if the cache has outgrown its budget.
+func (c *Captain) collectImages() {
+  if c.imageBudget <= 0 {return}
+  removed, err := c.state.CollectImages(c.imageBudget)
+  if err != nil {log.Println(err)}
+  if len(removed) > 0 {log.Println("Removed unused images:", removed)}
+}
+
+// Tasks returns the registry of tasks sent to this captain.
+func (c *Captain) Tasks() *Registry {return c.tasks}
+
+// Returns the url a captain joins a spinner at.
+func spinnerURL(spinner_name string) string {
+  return "ws://"+spinner_name+":5912/join"
+}
+
 type BeaconResponse struct {
   Valid         bool    `json:"Valid"`  // true if find a spinner
   Token         string  `json:"Token"`
@@ -81,7 +157,8 @@ func (c *Captain) QueryBeacon(beaconURL string, selfSpin bool) (string, error) {
   // selfSpin
   if selfSpin || !res.Valid {
     log.Println("Self-spining... Building up connection to spinner...")
-    res.OverlayName, res.ContainerName= c.SelfSpin()
+    res.OverlayName, res.ContainerName, err = c.SelfSpin()
+    if err != nil {return "",err}
     // just attach the overlay since local spinner already joined swarm
     err = c.state.JoinOverlay(c.name, res.OverlayName)
     if err != nil {return "",err}
@@ -90,6 +167,9 @@ func (c *Captain) QueryBeacon(beaconURL string, selfSpin bool) (string, error) {
     err = c.state.JoinSwarmAndOverlay(res.Token, res.Ip, c.name, res.OverlayName)
     if err != nil {return "",err}
   }
+  c.mu.Lock()
+  c.overlay = res.OverlayName
+  c.mu.Unlock()
 
   // return the selected spinner id (name)
   return res.ContainerName, nil
@@ -99,11 +179,47 @@ func (c *Captain) QueryBeacon(beaconURL string, selfSpin bool) (string, error) {
 // Should be changed to logging or a logging system.
 // Kubeedge uses Mosquito for example.
 func (c *Captain) ExecuteConfig(config *dockercntrl.Config, write chan interface{}) {
+  c.metrics.taskReceived(config.Id)
+  if !c.accept(config) {
+    c.refuse(config, errors.New("Captain is shutting down"), write)
+    return
+  }
+  if config.Id != nil {defer c.inflight.Done()}
+  if !c.tasks.Add(config.Id) {
+    c.refuse(config, fmt.Errorf("Task %s is already known to the captain", config.Id), write)
+    return
+  }
+  defer c.collectImages()
+  defer c.reapSoon()
+  defer c.observe(config)
+  if config.Deadline != nil && time.Now().After(*config.Deadline) {
+    c.fail(config, StageTimeout, timeoutError(config, 0), nil, write)
+    return
+  }
+  if err := c.admission.Admit(config); err != nil {
+    c.reject(config, err, write)
+    return
+  }
+  defer c.admission.Release(config.Id)
+  if write != nil {config.OnProgress = c.pullProgress(config, write)}
+  config.OnPulled = c.metrics.pulled
+  config.OnStart = func(inspection *dockercntrl.Inspection) {
+    c.tasks.Running(config.Id)
+    c.tasks.Published(config.Id, inspection.Ports)
+    if write == nil || (len(inspection.Ports) == 0 && !config.Service) {return}
+    c.send(write, &spinresp.Response{
+      Id: config.Id,
+      Code: Started,
+      Data: &TaskStarted{Ports: inspection.Ports},
+    })
+  }
   container, err := c.state.Create(config)
   if err != nil {
-    log.Println(err)
+    c.fail(config, dockercntrl.StageCreate, err, nil, write)
     return
   }
+  c.tasks.Created(config.Id, container.ID)
+  if config.Id == nil {c.addSystem(container)}
   // // For debugging
   // config.Storage = true
   // // ^^ Remove
@@ -128,23 +244,211 @@ func (c *Captain) ExecuteConfig(config *dockercntrl.Config, write chan interface
   // connect all new containers under captain to bridge network
   err = c.state.NetworkConnect(container)
   if err != nil {
-    log.Println(err)
+    c.fail(config, dockercntrl.StageNetwork, err, nil, write)
+    return
+  }
+  if config.Service {
+    c.runService(config, container, write)
+    return
+  }
+  if config.Stream && write != nil {
+    c.streamContainer(config, container, write)
     return
   }
   // start and wait this container
-  s, err := c.state.Run(container)
+  timedOut := c.enforceDeadline(config, container)
+  result, err := c.state.Run(container)
+  if timedOut() {
+    c.fail(config, StageTimeout, timeoutError(config, exitCode(err)), result, write)
+    return
+  }
   if err != nil {
-    log.Println(err)
+    c.fail(config, dockercntrl.StageStart, err, result, write)
     return
   }
+  c.tasks.Finish(config.Id, TaskExited, 0)
   log.Println("Task Container Output: ")
-  fmt.Println(*s)
+  fmt.Println(result.Stdout)
   // for system containers: write = nil
   if write != nil {
-    write <- &spinresp.Response{
+    c.send(write, &spinresp.Response{
       Id: config.Id,
       Code: spinresp.Success,
-      Data: *s,
+      Data: result,
+    })
+  }
+}
+
+// Minimum time between two Pulling responses about the same layer,
+// unless the layer's status changes.
+const ProgressInterval = time.Second
+
+// Returns a callback relaying the pull progress of a task to the
+// spinner as Pulling responses. Progress within a layer's status is
+// sent at most once per ProgressInterval.
+func (c *Captain) pullProgress(config *dockercntrl.Config, write chan interface{}) dockercntrl.ProgressFunc {
+  type relayed struct {
+    status  string
+    at      time.Time
+  }
+  last := make(map[string]relayed)
+  return func(progress *dockercntrl.PullProgress) {
+    prev, ok := last[progress.Layer]
+    if ok && prev.status == progress.Status && time.Since(prev.at) < ProgressInterval {return}
+    last[progress.Layer] = relayed{status: progress.Status, at: time.Now()}
+    c.send(write, &spinresp.Response{
+      Id: config.Id,
+      Code: Pulling,
+      Data: progress,
+    })
+  }
+}
+
+// Runs a container, forwarding its output to the spinner as it is
+// produced, followed by the exit code once the container stops.
+func (c *Captain) streamContainer(config *dockercntrl.Config, container *dockercntrl.Container, write chan interface{}) {
+  chunks := make(chan *dockercntrl.Chunk)
+  done := make(chan int)
+  seq := 0
+  go func() {
+    for chunk := range chunks {
+      c.send(write, &spinresp.Response{
+        Id: config.Id,
+        Code: Output,
+        Data: &OutputChunk{Seq: seq, Stream: chunk.Stream, Data: chunk.Data},
+      })
+      seq++
     }
+    close(done)
+  }()
+  timedOut := c.enforceDeadline(config, container)
+  code, err := c.state.Stream(container, chunks)
+  <-done
+  if timedOut() {
+    c.fail(config, StageTimeout, timeoutError(config, code), nil, write)
+    return
+  }
+  if err != nil {
+    c.fail(config, dockercntrl.StageStart, err, nil, write)
+    return
+  }
+  c.tasks.Finish(config.Id, TaskExited, code)
+  c.send(write, &spinresp.Response{
+    Id: config.Id,
+    Code: Exit,
+    Data: &ExitStatus{Seq: seq, ExitCode: code},
+  })
+}
+
+// Starts a service, reporting it as running once started, and follows
+// it until it stops for good, relaying each event to the spinner, such
+// as its restarts and changes in health. Restarts are left to docker,
+// as the service's restart policy decides.
+func (c *Captain) runService(config *dockercntrl.Config, container *dockercntrl.Container, write chan interface{}) {
+  if err := c.state.Start(container); err != nil {
+    c.fail(config, dockercntrl.StageStart, err, nil, write)
+    return
+  }
+  events := make(chan *dockercntrl.Event)
+  done := make(chan int)
+  go func() {
+    restarts := 0
+    for event := range events {
+      switch event.Action {
+      case dockercntrl.EventStart:
+        restarts++
+        c.tasks.Restarted(config.Id)
+      case dockercntrl.EventHealth:
+        c.tasks.Health(config.Id, event.Health)
+      }
+      log.Println("Service", config.Name, event.Action, event.Health)
+      if write == nil {continue}
+      c.send(write, &spinresp.Response{
+        Id: config.Id,
+        Code: ServiceEvent,
+        Data: &ServiceStatus{Event: event, Restarts: restarts},
+      })
+    }
+    close(done)
+  }()
+  timedOut := c.enforceDeadline(config, container)
+  code, err := c.state.Monitor(container, events)
+  <-done
+  if timedOut() {
+    c.fail(config, StageTimeout, timeoutError(config, code), nil, write)
+    return
+  }
+  if err != nil {
+    c.fail(config, dockercntrl.StageWait, err, nil, write)
+    return
+  }
+  c.tasks.Finish(config.Id, TaskExited, code)
+  if write == nil {return}
+  c.send(write, &spinresp.Response{
+    Id: config.Id,
+    Code: Exit,
+    Data: &ExitStatus{ExitCode: code},
+  })
+}
+
+// Refuses a task before it is tracked, such as one whose id is already
+// tracked, leaving the record and the room held by the task with that
+// id untouched.
+func (c *Captain) refuse(config *dockercntrl.Config, err error, write chan interface{}) {
+  log.Println(err)
+  c.metrics.taskFailed(config.Id, StageAdmission)
+  if write == nil {return}
+  c.send(write, &spinresp.Response{
+    Id: config.Id,
+    Code: Failed,
+    Data: &Failure{Stage: StageAdmission, Error: err.Error()},
+  })
+}
+
+// Logs a failed task and reports it to the spinner. The stage is taken
+// from the error when the runtime supplies one, otherwise the given
+// stage is used. Result holds the outcome of a task that ran, if any.
+func (c *Captain) fail(config *dockercntrl.Config, stage string, err error, result *dockercntrl.Result, write chan interface{}) {
+  log.Println(err)
+  failure := &Failure{Stage: stage, Error: err.Error()}
+  var taskErr *dockercntrl.TaskError
+  if errors.As(err, &taskErr) {
+    failure.Stage = taskErr.Stage
+    failure.ExitCode = taskErr.ExitCode
+    failure.Error = taskErr.Err.Error()
+  }
+  if result != nil {
+    failure.Output = result.Stdout
+    failure.Result = result
+  }
+  c.metrics.taskFailed(config.Id, failure.Stage)
+  state := TaskFailed
+  if failure.Stage == StageTimeout {state = TaskTimedOut}
+  c.tasks.Finish(config.Id, state, failure.ExitCode)
+  // for system containers: write = nil
+  if write == nil {return}
+  c.send(write, &spinresp.Response{
+    Id: config.Id,
+    Code: Failed,
+    Data: failure,
+  })
+}
+
+// Reports a task the captain has no room for. Errors other than a
+// shortage mean the captain could not tell, and fail the task.
+func (c *Captain) reject(config *dockercntrl.Config, err error, write chan interface{}) {
+  shortage, ok := err.(*ResourceShortage)
+  if !ok {
+    c.fail(config, StageAdmission, err, nil, write)
+    return
   }
+  log.Println(err)
+  c.tasks.Finish(config.Id, TaskFailed, 0)
+  c.metrics.taskFailed(config.Id, StageAdmission)
+  if write == nil {return}
+  c.send(write, &spinresp.Response{
+    Id: config.Id,
+    Code: InsufficientResources,
+    Data: shortage,
+  })
 }
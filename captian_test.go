@@ -1,7 +1,19 @@
 package captain_test
 
 import (
+  "context"
+  "encoding/json"
+  "net/http"
+  "net/http/httptest"
+  "errors"
+  "io/ioutil"
+  "strings"
   "testing"
+  "time"
+  "github.com/armadanet/captain"
+  "github.com/armadanet/captain/dockercntrl"
+  "github.com/armadanet/spinner/spinresp"
+  "github.com/google/uuid"
 )
 
 func TestEmpty(t *testing.T) {
@@ -9,3 +21,867 @@ func TestEmpty(t *testing.T) {
     t.Errorf("Fail")
   }
 }
+
+func newTestCaptain(t *testing.T) (*captain.Captain, *dockercntrl.Fake) {
+  fake := dockercntrl.NewFake()
+  c, err := captain.New("captain-test", fake)
+  if err != nil {t.Fatal(err)}
+  return c, fake
+}
+
+func newTestConfig() *dockercntrl.Config {
+  id := uuid.New()
+  return &dockercntrl.Config{
+    Id: &id,
+    Image: "docker.io/library/alpine",
+    Cmd: []string{"echo", "hello"},
+    Name: "task-" + id.String(),
+    Limits: &dockercntrl.Limits{CPUShares: 2},
+  }
+}
+
+func TestNewRequiresRuntime(t *testing.T) {
+  if _, err := captain.New("captain-test", nil); err == nil {
+    t.Errorf("Expected an error without a runtime")
+  }
+}
+
+func TestExecuteConfig(t *testing.T) {
+  c, fake := newTestCaptain(t)
+  fake.Output = "hello\n"
+  fake.Stderr = "warning\n"
+  config := newTestConfig()
+  write := make(chan interface{}, 1)
+  c.ExecuteConfig(config, write)
+
+  res, ok := (<-write).(*spinresp.Response)
+  if !ok {t.Fatal("Expected a *spinresp.Response")}
+  if res.Code != spinresp.Success {t.Errorf("Code = %d, want %d", res.Code, spinresp.Success)}
+  if res.Id != config.Id {t.Errorf("Response id does not match the config")}
+  result, ok := res.Data.(*dockercntrl.Result)
+  if !ok {t.Fatalf("Expected a result, got %+v", res.Data)}
+  if result.Stdout != "hello" || result.Stderr != "warning" {
+    t.Errorf("Unexpected output %q, %q", result.Stdout, result.Stderr)
+  }
+  if result.ExitCode != 0 || result.OOMKilled {t.Errorf("Unexpected result %+v", result)}
+  if result.StartedAt.IsZero() || result.FinishedAt.Before(result.StartedAt) {
+    t.Errorf("Unexpected timing %v to %v", result.StartedAt, result.FinishedAt)
+  }
+  if result.Digest != dockercntrl.FakeDigest(config.Image) {
+    t.Errorf("Digest = %q, want %q", result.Digest, dockercntrl.FakeDigest(config.Image))
+  }
+}
+
+func TestExecuteConfigStream(t *testing.T) {
+  c, fake := newTestCaptain(t)
+  fake.Output = "hello\n"
+  fake.ExitCode = 3
+  config := newTestConfig()
+  config.Stream = true
+  write := make(chan interface{}, 2)
+  c.ExecuteConfig(config, write)
+
+  out := (<-write).(*spinresp.Response)
+  chunk, ok := out.Data.(*captain.OutputChunk)
+  if out.Code != captain.Output || !ok {t.Fatalf("Expected an output chunk, got %+v", out)}
+  if chunk.Seq != 0 || chunk.Stream != dockercntrl.STDOUT || chunk.Data != "hello\n" {
+    t.Errorf("Unexpected chunk %+v", chunk)
+  }
+  exit := (<-write).(*spinresp.Response)
+  status, ok := exit.Data.(*captain.ExitStatus)
+  if exit.Code != captain.Exit || !ok {t.Fatalf("Expected an exit status, got %+v", exit)}
+  if status.Seq != 1 || status.ExitCode != 3 {t.Errorf("Unexpected exit status %+v", status)}
+}
+
+func expectFailure(t *testing.T, write chan interface{}, stage string, code int64) *captain.Failure {
+  res := (<-write).(*spinresp.Response)
+  failure, ok := res.Data.(*captain.Failure)
+  if res.Code != captain.Failed || !ok {t.Fatalf("Expected a failure, got %+v", res)}
+  if failure.Stage != stage {t.Errorf("Stage = %q, want %q", failure.Stage, stage)}
+  if failure.ExitCode != code {t.Errorf("ExitCode = %d, want %d", failure.ExitCode, code)}
+  return failure
+}
+
+func TestExecuteConfigFailures(t *testing.T) {
+  for method, stage := range map[string]string{
+    "Pull": dockercntrl.StagePull,
+    "Create": dockercntrl.StageCreate,
+    "NetworkConnect": dockercntrl.StageNetwork,
+    "Run": dockercntrl.StageStart,
+  } {
+    c, fake := newTestCaptain(t)
+    fake.Errors[method] = errors.New("boom")
+    write := make(chan interface{}, 1)
+    c.ExecuteConfig(newTestConfig(), write)
+    failure := expectFailure(t, write, stage, 0)
+    if failure.Error != "boom" {t.Errorf("Error = %q, want %q", failure.Error, "boom")}
+  }
+}
+
+func TestExecuteConfigNonZeroExit(t *testing.T) {
+  c, fake := newTestCaptain(t)
+  fake.Output = "oops"
+  fake.ExitCode = 137
+  fake.OOMKilled = true
+  write := make(chan interface{}, 1)
+  c.ExecuteConfig(newTestConfig(), write)
+  failure := expectFailure(t, write, dockercntrl.StageWait, 137)
+  if failure.Output != "oops" {t.Errorf("Output = %q, want %q", failure.Output, "oops")}
+  if failure.Result == nil || failure.Result.ExitCode != 137 || !failure.Result.OOMKilled {
+    t.Errorf("Unexpected result %+v", failure.Result)
+  }
+}
+
+func TestMessageDecoding(t *testing.T) {
+  var task captain.Message
+  if err := json.Unmarshal([]byte(`{"image": "alpine", "command": ["ls"]}`), &task); err != nil {t.Fatal(err)}
+  if task.Action != "" || task.Config == nil || task.Config.Image != "alpine" {
+    t.Errorf("Expected a task, got %+v", task)
+  }
+  id := uuid.New()
+  var command captain.Message
+  raw := `{"action": "kill", "nebula_id": "` + id.String() + `"}`
+  if err := json.Unmarshal([]byte(raw), &command); err != nil {t.Fatal(err)}
+  if command.Action != captain.Kill || command.Config == nil || *command.Config.Id != id {
+    t.Errorf("Expected a kill command, got %+v", command)
+  }
+}
+
+func TestExecuteCommand(t *testing.T) {
+  c, fake := newTestCaptain(t)
+  config := newTestConfig()
+  container, err := fake.Create(config)
+  if err != nil {t.Fatal(err)}
+  write := make(chan interface{}, 1)
+
+  c.ExecuteCommand(&captain.Message{Action: captain.Remove, Config: &dockercntrl.Config{Id: config.Id}}, write)
+  res := (<-write).(*spinresp.Response)
+  ack := res.Data.(*captain.CommandAck)
+  if res.Code != captain.Ack || !ack.Ok || res.Id != config.Id {t.Errorf("Unexpected ack %+v %+v", res, ack)}
+  if _, ok := fake.Container(container.ID); ok {t.Errorf("Container was not removed")}
+
+  c.ExecuteCommand(&captain.Message{Action: captain.Kill, Config: &dockercntrl.Config{Id: config.Id}}, write)
+  res = (<-write).(*spinresp.Response)
+  ack = res.Data.(*captain.CommandAck)
+  if ack.Ok || ack.Error == "" {t.Errorf("Expected a failed ack for a missing task, got %+v", ack)}
+}
+
+func TestRegistryTracksTasks(t *testing.T) {
+  c, fake := newTestCaptain(t)
+  ok := newTestConfig()
+  c.ExecuteConfig(ok, make(chan interface{}, 1))
+  task, found := c.Tasks().Get(ok.Id)
+  if !found || task.State != captain.TaskExited || task.ContainerID == "" {
+    t.Errorf("Unexpected record for a finished task: %+v", task)
+  }
+
+  fake.ExitCode = 4
+  bad := newTestConfig()
+  c.ExecuteConfig(bad, make(chan interface{}, 1))
+  task, _ = c.Tasks().Get(bad.Id)
+  if task.State != captain.TaskFailed || task.ExitCode != 4 {
+    t.Errorf("Unexpected record for a failed task: %+v", task)
+  }
+  if len(c.Tasks().List()) != 2 {t.Errorf("Expected two tasks, got %d", len(c.Tasks().List()))}
+}
+
+func TestDuplicateTask(t *testing.T) {
+  c, fake := newTestCaptain(t)
+  c.SetContribution(captain.Contribution{Memory: 1 << 30})
+  fake.Hang = true
+  config := newTestConfig()
+  config.Limits.Memory = 1 << 30
+  go c.ExecuteConfig(config, make(chan interface{}, 1))
+  var task captain.Task
+  for deadline := time.Now().Add(2 * time.Second); task.State != captain.TaskRunning; task, _ = c.Tasks().Get(config.Id) {
+    if time.Now().After(deadline) {t.Fatalf("Task never ran: %+v", task)}
+    time.Sleep(10 * time.Millisecond)
+  }
+
+  duplicate := *config
+  write := make(chan interface{}, 1)
+  c.ExecuteConfig(&duplicate, write)
+  if failure := expectFailure(t, write, captain.StageAdmission, 0); !strings.Contains(failure.Error, "already") {
+    t.Errorf("Unexpected failure %+v", failure)
+  }
+  if record, _ := c.Tasks().Get(config.Id); record.ContainerID != task.ContainerID || record.State != captain.TaskRunning {
+    t.Errorf("Duplicate changed the task's record to %+v", record)
+  }
+  other := newTestConfig()
+  other.Limits.Memory = 8 << 20
+  c.ExecuteConfig(other, write)
+  if res := (<-write).(*spinresp.Response); res.Code != captain.InsufficientResources {
+    t.Errorf("Expected the first task to still hold its room, got %+v", res)
+  }
+  c.ExecuteCommand(&captain.Message{Action: captain.Kill, Config: &dockercntrl.Config{Id: config.Id}}, write)
+  if ack := (<-write).(*spinresp.Response).Data.(*captain.CommandAck); !ack.Ok {t.Errorf("Expected the task to be killed, got %+v", ack)}
+}
+
+func TestStartFailureNotRunning(t *testing.T) {
+  c, fake := newTestCaptain(t)
+  fake.Errors["Run"] = errors.New("boom")
+  config := newTestConfig()
+  c.ExecuteConfig(config, make(chan interface{}, 1))
+  if task, _ := c.Tasks().Get(config.Id); task.State != captain.TaskFailed || !task.Started.IsZero() {
+    t.Errorf("Expected a task that failed to start never to have run, got %+v", task)
+  }
+}
+
+func TestRegistryReconcile(t *testing.T) {
+  fake := dockercntrl.NewFake()
+  fake.ExitCode = 1
+  config := newTestConfig()
+  container, err := fake.Create(config)
+  if err != nil {t.Fatal(err)}
+  fake.Run(container)
+  if _, err := fake.Create(&dockercntrl.Config{Image: "cargo", Name: "armada-storage", Limits: &dockercntrl.Limits{}}); err != nil {
+    t.Fatal(err)
+  }
+
+  left := newTestConfig()
+  running, err := fake.Create(left)
+  if err != nil {t.Fatal(err)}
+  if err := fake.Start(running); err != nil {t.Fatal(err)}
+
+  registry := captain.NewRegistry()
+  if err := registry.Reconcile(fake); err != nil {t.Fatal(err)}
+  if len(registry.List()) != 2 {t.Fatalf("Expected only the task containers, got %+v", registry.List())}
+  if task, _ := registry.Get(config.Id); task.ContainerID != container.ID || task.State != captain.TaskExited || task.ExitCode != 1 {
+    t.Errorf("Unexpected reconciled task %+v", task)
+  }
+  task, _ := registry.Get(left.Id)
+  if inspection, _ := fake.Inspect(running); inspection.Running || task.State != captain.TaskExited {
+    t.Errorf("Expected the container left running to be stopped, got %+v", task)
+  }
+
+  fake.Errors["Inspect"] = errors.New("gone")
+  skipped := captain.NewRegistry()
+  if err := skipped.Reconcile(fake); err != nil || len(skipped.List()) != 0 {
+    t.Errorf("Expected containers that cannot be inspected to be skipped, got %+v, %v", skipped.List(), err)
+  }
+}
+
+func TestRetention(t *testing.T) {
+  for policy, kept := range map[string]int{
+    "": 3,
+    "none": 0,
+    "failed": 1,
+    "last:2": 2,
+    "for:1h": 3,
+    "for:0s": 0,
+  } {
+    c, fake := newTestCaptain(t)
+    retention, err := captain.ParseRetention(policy)
+    if err != nil {t.Fatal(err)}
+    c.SetRetention(retention)
+    for _, code := range []int64{0, 5, 0} {
+      fake.ExitCode = code
+      c.ExecuteConfig(newTestConfig(), make(chan interface{}, 1))
+    }
+    c.Reap()
+    tasks := c.Tasks().List()
+    if len(tasks) != kept {t.Errorf("Policy %q kept %d tasks, want %d", policy, len(tasks), kept)}
+    containers, _ := fake.List()
+    if len(containers) != kept {t.Errorf("Policy %q kept %d containers, want %d", policy, len(containers), kept)}
+    if policy == "failed" && len(tasks) == 1 && tasks[0].State != captain.TaskFailed {
+      t.Errorf("Expected the failed task to be kept, got %+v", tasks[0])
+    }
+  }
+  for _, policy := range []string{"all", "none:1", "last", "last:-1", "for:soon"} {
+    if _, err := captain.ParseRetention(policy); err == nil {t.Errorf("Expected %q to be rejected", policy)}
+  }
+}
+
+func TestRunShutsDownWhenSpinnerUnreachable(t *testing.T) {
+  beacon := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    json.NewEncoder(w).Encode(&captain.BeaconResponse{
+      Valid: true,
+      Token: "token",
+      Ip: "127.0.0.1",
+      OverlayName: "overlay",
+      ContainerName: "127.0.0.1:1",
+    })
+  }))
+  defer beacon.Close()
+
+  c, fake := newTestCaptain(t)
+  c.Run(context.Background(), beacon.URL, false)
+
+  if networks := fake.Attached("captain-test"); len(networks) != 0 {
+    t.Errorf("Expected the captain to detach from all networks, still on %v", networks)
+  }
+  if fake.InSwarm() {t.Errorf("Expected the captain to leave the swarm")}
+}
+
+func TestRunDrainsTasksOnCancel(t *testing.T) {
+  ctx, cancel := context.WithCancel(context.Background())
+  beacon := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    <- ctx.Done()
+    http.Error(w, "beacon gone", http.StatusServiceUnavailable)
+  }))
+  defer beacon.Close()
+
+  c, fake := newTestCaptain(t)
+  fake.Hang = true
+  config := newTestConfig()
+  write := make(chan interface{}, 1)
+  go c.ExecuteConfig(config, write)
+  for deadline := time.Now().Add(2 * time.Second); ; {
+    if task, _ := c.Tasks().Get(config.Id); task.State == captain.TaskRunning {break}
+    if time.Now().After(deadline) {t.Fatal("Task never ran")}
+    time.Sleep(10 * time.Millisecond)
+  }
+  done := make(chan struct{})
+  go func() {
+    c.Run(ctx, beacon.URL, false)
+    close(done)
+  }()
+  cancel()
+  time.Sleep(200 * time.Millisecond)
+
+  select {
+  case <- done:
+    t.Fatal("Expected the captain to wait for the running task")
+  default:
+  }
+  late := newTestConfig()
+  lateWrite := make(chan interface{}, 1)
+  c.ExecuteConfig(late, lateWrite)
+  expectFailure(t, lateWrite, captain.StageAdmission, 0)
+  if _, ok := c.Tasks().Get(late.Id); ok {t.Errorf("Expected a task sent during shutdown not to be tracked")}
+
+  task, _ := c.Tasks().Get(config.Id)
+  if err := fake.Exit(task.ContainerID, 0); err != nil {t.Fatal(err)}
+  if res := (<-write).(*spinresp.Response); res.Code != spinresp.Success {
+    t.Errorf("Expected the drained task to report success, got %+v", res)
+  }
+  select {
+  case <- done:
+  case <- time.After(2 * time.Second):
+    t.Fatal("Captain did not stop once its task finished")
+  }
+  if fake.InSwarm() {t.Errorf("Expected the captain to leave the swarm")}
+}
+
+func TestAdmission(t *testing.T) {
+  fake := dockercntrl.NewFake()
+  fake.Node = dockercntrl.NodeInfo{NCPU: 8, MemTotal: 16 << 30}
+  admission := captain.NewAdmission(fake, captain.Contribution{CPUs: 2, Memory: 1 << 30})
+
+  first := newTestConfig()
+  first.Limits.NanoCPUs = 15e8
+  first.Limits.Memory = 512 << 20
+  if err := admission.Admit(first); err != nil {t.Fatalf("Expected the first task to be admitted: %v", err)}
+
+  second := newTestConfig()
+  second.Limits.NanoCPUs = 1e9
+  err := admission.Admit(second)
+  shortage, ok := err.(*captain.ResourceShortage)
+  if !ok {t.Fatalf("Expected a resource shortage, got %v", err)}
+  if shortage.AvailableCPUs != 0.5 || shortage.AvailableMemory != 512 << 20 {
+    t.Errorf("Unexpected shortage %+v", shortage)
+  }
+
+  admission.Release(first.Id)
+  if err := admission.Admit(second); err != nil {t.Errorf("Expected room after release: %v", err)}
+}
+
+func TestAdmissionDefaultLimits(t *testing.T) {
+  fake := dockercntrl.NewFake()
+  fake.Node = dockercntrl.NodeInfo{NCPU: 8, MemTotal: 16 << 30}
+  admission := captain.NewAdmission(fake, captain.Contribution{CPUs: 1, Memory: 64 << 20})
+
+  unlimited := newTestConfig()
+  if err := admission.Admit(unlimited); err != nil {t.Fatalf("Expected the task to be admitted: %v", err)}
+  if unlimited.Limits.NanoCPUs != 1e9 || unlimited.Limits.Memory != 64 << 20 || unlimited.Limits.CPUShares != 2 {
+    t.Errorf("Expected default limits capped at the contribution, got %+v", *unlimited.Limits)
+  }
+  for i := 0; i < 3; i++ {
+    if _, ok := admission.Admit(newTestConfig()).(*captain.ResourceShortage); !ok {
+      t.Errorf("Expected an unlimited task past the contribution to be refused")
+    }
+  }
+
+  open := captain.NewAdmission(fake, captain.Contribution{})
+  config := newTestConfig()
+  if err := open.Admit(config); err != nil || config.Limits.NanoCPUs != 0 || config.Limits.Memory != 0 {
+    t.Errorf("Expected no default limits without a contribution, got %+v, %v", *config.Limits, err)
+  }
+}
+
+func TestAdmissionInvalidLimits(t *testing.T) {
+  fake := dockercntrl.NewFake()
+  admission := captain.NewAdmission(fake, captain.Contribution{Memory: 64 << 20})
+  for _, limits := range []dockercntrl.Limits{{Memory: -1 << 40}, {NanoCPUs: -1e9}} {
+    config := newTestConfig()
+    config.Limits = &limits
+    err := admission.Admit(config)
+    if _, short := err.(*captain.ResourceShortage); err == nil || short {
+      t.Errorf("Expected limits %+v to be refused as invalid, got %v", limits, err)
+    }
+  }
+  config := newTestConfig()
+  config.Limits.Memory = 64 << 20
+  if err := admission.Admit(config); err != nil {t.Errorf("Expected refused tasks to hold no room: %v", err)}
+  if err := admission.Admit(newTestConfig()); err == nil {t.Errorf("Expected the contribution to be used up")}
+}
+
+func TestInvalidConfigNotPulled(t *testing.T) {
+  c, fake := newTestCaptain(t)
+  config := newTestConfig()
+  config.Restart = &dockercntrl.RestartPolicy{Name: dockercntrl.RestartAlways}
+  write := make(chan interface{}, 1)
+  c.ExecuteConfig(config, write)
+  expectFailure(t, write, dockercntrl.StageVerify, 0)
+  if fake.Pulled(config.Image) {t.Errorf("An invalid task should never be pulled")}
+}
+
+func TestExecuteConfigInsufficientResources(t *testing.T) {
+  c, _ := newTestCaptain(t)
+  c.SetContribution(captain.Contribution{Memory: 256 << 20})
+  config := newTestConfig()
+  config.Limits.Memory = 512 << 20
+  write := make(chan interface{}, 1)
+  c.ExecuteConfig(config, write)
+  res := (<-write).(*spinresp.Response)
+  if _, ok := res.Data.(*captain.ResourceShortage); res.Code != captain.InsufficientResources || !ok {
+    t.Errorf("Expected an insufficient resources response, got %+v", res)
+  }
+  if task, _ := c.Tasks().Get(config.Id); task.State != captain.TaskFailed {
+    t.Errorf("Rejected task recorded as %q", task.State)
+  }
+}
+
+func TestStatus(t *testing.T) {
+  c, fake := newTestCaptain(t)
+  fake.Node = dockercntrl.NodeInfo{NCPU: 2, MemTotal: 4 << 30}
+  c.ExecuteConfig(newTestConfig(), make(chan interface{}, 1))
+  status := c.Status()
+  if status.Name != "captain-test" || status.TotalCPUs != 2 || status.FreeMemory != 4 << 30 {
+    t.Errorf("Unexpected status %+v", status)
+  }
+  if status.Images != 1 || status.RunningTasks != 0 {
+    t.Errorf("Unexpected task and image counts %+v", status)
+  }
+}
+
+func TestPullPolicy(t *testing.T) {
+  c, fake := newTestCaptain(t)
+  fake.AddImage("docker.io/library/alpine:3.11", 1 << 20, time.Now())
+
+  cached := newTestConfig()
+  cached.Image = "docker.io/library/alpine:3.11"
+  c.ExecuteConfig(cached, make(chan interface{}, 1))
+  if fake.Pulled(cached.Image) {t.Errorf("Expected the cached image to be used")}
+
+  always := newTestConfig()
+  always.Image = cached.Image
+  always.PullPolicy = dockercntrl.PullAlways
+  c.ExecuteConfig(always, make(chan interface{}, 1))
+  if !fake.Pulled(cached.Image) {t.Errorf("Expected the image to be pulled")}
+
+  never := newTestConfig()
+  never.Image = "docker.io/library/busybox:1.31"
+  never.PullPolicy = dockercntrl.PullNever
+  write := make(chan interface{}, 1)
+  c.ExecuteConfig(never, write)
+  expectFailure(t, write, dockercntrl.StagePull, 0)
+}
+
+func TestImageBudget(t *testing.T) {
+  c, fake := newTestCaptain(t)
+  c.SetImageBudget(1 << 20)
+  fake.AddImage("volunteer/own", 2 << 20, time.Now().Add(-2 * time.Hour))
+  first := newTestConfig()
+  first.Image = "docker.io/library/busybox"
+  c.ExecuteConfig(first, make(chan interface{}, 1))
+  c.ExecuteCommand(&captain.Message{Action: captain.Remove, Config: &dockercntrl.Config{Id: first.Id}}, make(chan interface{}, 1))
+  c.ExecuteConfig(newTestConfig(), make(chan interface{}, 1))
+
+  images, _ := fake.Images()
+  kept := map[string]bool{}
+  for _, img := range images {kept[img.Tags[0]] = true}
+  if len(images) != 2 || !kept["volunteer/own"] || !kept["docker.io/library/alpine"] {
+    t.Errorf("Expected only the pulled image no longer in use to be removed, got %v", kept)
+  }
+}
+
+func TestImageVerification(t *testing.T) {
+  c, fake := newTestCaptain(t)
+  fake.Policy = &dockercntrl.ImagePolicy{Allow: []string{"docker.io/library/*"}}
+
+  pinned := newTestConfig()
+  pinned.Digest = dockercntrl.FakeDigest(pinned.Image)
+  write := make(chan interface{}, 1)
+  c.ExecuteConfig(pinned, write)
+  if res := (<-write).(*spinresp.Response); res.Code != spinresp.Success {
+    t.Errorf("Expected a pinned image to run, got %+v", res)
+  }
+  task, _ := c.Tasks().Get(pinned.Id)
+  if container, _ := fake.Container(task.ContainerID); container.Config.Image != "docker.io/library/alpine@" + pinned.Digest {
+    t.Errorf("Expected the container to run the verified digest, got %s", container.Config.Image)
+  }
+
+  mismatched := newTestConfig()
+  mismatched.Digest = "sha256:0000"
+  c.ExecuteConfig(mismatched, write)
+  expectFailure(t, write, dockercntrl.StageVerify, 0)
+
+  disallowed := newTestConfig()
+  disallowed.Image = "docker.io/someone/miner"
+  c.ExecuteConfig(disallowed, write)
+  expectFailure(t, write, dockercntrl.StageVerify, 0)
+  if fake.Pulled(disallowed.Image) {t.Errorf("A disallowed image should never be pulled")}
+
+  fake.Policy.RequireDigest = true
+  system := &dockercntrl.Config{Image: disallowed.Image, Name: "armada-storage", Limits: &dockercntrl.Limits{}}
+  system.SetSystem()
+  if _, err := fake.Create(system); err != nil {t.Errorf("Expected the captain's own containers to be exempt: %v", err)}
+}
+
+func TestPullProgress(t *testing.T) {
+  c, fake := newTestCaptain(t)
+  fake.Progress = []*dockercntrl.PullProgress{
+    {Layer: "c9b1b535fdd9", Status: "Downloading", Current: 1, Total: 4},
+    {Layer: "c9b1b535fdd9", Status: "Downloading", Current: 2, Total: 4},
+    {Layer: "c9b1b535fdd9", Status: "Pull complete"},
+  }
+  config := newTestConfig()
+  write := make(chan interface{}, 4)
+  c.ExecuteConfig(config, write)
+  close(write)
+  statuses := []string{}
+  for msg := range write {
+    res := msg.(*spinresp.Response)
+    if res.Code != captain.Pulling {continue}
+    progress := res.Data.(*dockercntrl.PullProgress)
+    if progress.Image != config.Image {t.Errorf("Expected progress for %s, got %+v", config.Image, progress)}
+    statuses = append(statuses, progress.Status)
+  }
+  // the second download event falls within the progress interval
+  if len(statuses) != 2 || statuses[0] != "Downloading" || statuses[1] != "Pull complete" {
+    t.Errorf("Unexpected pulling updates: %v", statuses)
+  }
+}
+
+func TestSecurityPolicy(t *testing.T) {
+  c, fake := newTestCaptain(t)
+  fake.Hardening = &dockercntrl.SecurityPolicy{User: "nobody", NonRoot: true, ReadOnly: true}
+
+  config := newTestConfig()
+  write := make(chan interface{}, 1)
+  c.ExecuteConfig(config, write)
+  if res := (<-write).(*spinresp.Response); res.Code != spinresp.Success {
+    t.Fatalf("Expected the hardened task to run, got %+v", res)
+  }
+  task, _ := c.Tasks().Get(config.Id)
+  container, _ := fake.Container(task.ContainerID)
+  security := container.Config.Security
+  if security == nil || security.User != "nobody" || !security.ReadOnly {
+    t.Errorf("Expected the baseline to be applied, got %+v", security)
+  }
+
+  root := newTestConfig()
+  root.Security = &dockercntrl.Security{User: "root"}
+  c.ExecuteConfig(root, write)
+  expectFailure(t, write, dockercntrl.StageVerify, 0)
+}
+
+func TestPrivilegedTaskRefused(t *testing.T) {
+  c, fake := newTestCaptain(t)
+  var msg captain.Message
+  if err := json.Unmarshal([]byte(`{"image": "alpine", "privileged": true}`), &msg); err != nil {t.Fatal(err)}
+  id := uuid.New()
+  msg.Config.Id = &id
+  write := make(chan interface{}, 1)
+  c.ExecuteConfig(msg.Config, write)
+  expectFailure(t, write, dockercntrl.StageVerify, 0)
+  if fake.Pulled("alpine") {t.Errorf("A refused task should never be pulled")}
+}
+
+func TestTaskMounts(t *testing.T) {
+  c, fake := newTestCaptain(t)
+  var msg captain.Message
+  body := `{"image": "alpine", "storage": true, "mounts": [
+    {"type": "volume", "source": "cargo", "target": "/data"},
+    {"type": "scratch", "target": "/scratch"}
+  ]}`
+  if err := json.Unmarshal([]byte(body), &msg); err != nil {t.Fatal(err)}
+  id := uuid.New()
+  msg.Config.Id = &id
+  write := make(chan interface{}, 1)
+  c.ExecuteConfig(msg.Config, write)
+  if res := (<-write).(*spinresp.Response); res.Code != spinresp.Success {t.Fatalf("Expected success, got %+v", res)}
+
+  task, _ := c.Tasks().Get(&id)
+  container, _ := fake.Container(task.ContainerID)
+  if len(container.Config.Mounts) != 2 {t.Fatalf("Expected both mounts, got %+v", container.Config.Mounts)}
+  scratch := container.Config.Mounts[1].Source
+  if !fake.HasVolume(scratch) {t.Errorf("Expected scratch volume %q to be created", scratch)}
+
+  c.ExecuteCommand(&captain.Message{Action: captain.Remove, Config: &dockercntrl.Config{Id: &id}}, write)
+  <-write
+  if fake.HasVolume(scratch) {t.Errorf("Expected scratch volume %q to be removed with the task", scratch)}
+}
+
+func TestPublishedPorts(t *testing.T) {
+  c, _ := newTestCaptain(t)
+  config := newTestConfig()
+  config.Ports = []*dockercntrl.PortSpec{{Port: 80}, {Port: 53, Protocol: dockercntrl.UDP, HostPort: 5353}}
+  write := make(chan interface{}, 2)
+  c.ExecuteConfig(config, write)
+  res := (<-write).(*spinresp.Response)
+  if res.Code != captain.Started {t.Fatalf("Expected a started response, got %+v", res)}
+  ports := res.Data.(*captain.TaskStarted).Ports
+  if len(ports) != 2 || ports[0].Port != 80 || ports[0].HostPort != dockercntrl.FakeHostPort || ports[1].HostPort != 5353 {
+    t.Errorf("Unexpected published ports %+v", ports)
+  }
+  if res := (<-write).(*spinresp.Response); res.Code != spinresp.Success {t.Errorf("Expected success, got %+v", res)}
+  if task, _ := c.Tasks().Get(config.Id); len(task.Ports) != 2 {t.Errorf("Expected the ports on the task, got %+v", task)}
+}
+
+// Reads responses until one with the given code arrives.
+func expectResponse(t *testing.T, write chan interface{}, code int) *spinresp.Response {
+  t.Helper()
+  for {
+    select {
+    case msg := <-write:
+      if res := msg.(*spinresp.Response); res.Code == code {return res}
+    case <-time.After(2 * time.Second):
+      t.Fatalf("Expected a response with code %d", code)
+    }
+  }
+}
+
+func TestService(t *testing.T) {
+  c, fake := newTestCaptain(t)
+  config := newTestConfig()
+  config.Service = true
+  config.Restart = &dockercntrl.RestartPolicy{Name: dockercntrl.RestartOnFailure, MaxRetries: 2}
+  write := make(chan interface{}, 16)
+  done := make(chan int)
+  go func() {
+    c.ExecuteConfig(config, write)
+    close(done)
+  }()
+  expectResponse(t, write, captain.Started)
+  task, _ := c.Tasks().Get(config.Id)
+  if task.State != captain.TaskRunning {t.Errorf("Expected the service to be running, got %+v", task)}
+
+  for i := 0; i < 3; i++ {
+    if err := fake.Exit(task.ContainerID, 1); err != nil {t.Fatal(err)}
+    status := expectResponse(t, write, captain.ServiceEvent).Data.(*captain.ServiceStatus)
+    if status.Event.Action != dockercntrl.EventDie || status.Event.ExitCode != 1 {t.Errorf("Expected a die event, got %+v", status.Event)}
+    if i == 2 {break}
+    status = expectResponse(t, write, captain.ServiceEvent).Data.(*captain.ServiceStatus)
+    if status.Event.Action != dockercntrl.EventStart || status.Restarts != i+1 {t.Errorf("Expected restart %d, got %+v", i+1, status)}
+  }
+  exit := expectResponse(t, write, captain.Exit).Data.(*captain.ExitStatus)
+  if exit.ExitCode != 1 {t.Errorf("Expected exit code 1, got %d", exit.ExitCode)}
+  <-done
+  task, _ = c.Tasks().Get(config.Id)
+  if task.State != captain.TaskExited || task.Restarts != 2 {t.Errorf("Unexpected record for the service: %+v", task)}
+}
+
+func TestServiceStop(t *testing.T) {
+  c, fake := newTestCaptain(t)
+  config := newTestConfig()
+  config.Service = true
+  config.Restart = &dockercntrl.RestartPolicy{Name: dockercntrl.RestartAlways}
+  write := make(chan interface{}, 16)
+  go c.ExecuteConfig(config, write)
+  expectResponse(t, write, captain.Started)
+  task, _ := c.Tasks().Get(config.Id)
+  fake.Exit(task.ContainerID, 0)
+  expectResponse(t, write, captain.ServiceEvent)
+  if status := expectResponse(t, write, captain.ServiceEvent).Data.(*captain.ServiceStatus); status.Event.Action != dockercntrl.EventStart {
+    t.Errorf("Expected an always service to restart, got %+v", status.Event)
+  }
+
+  c.ExecuteCommand(&captain.Message{Action: captain.Cancel, Config: &dockercntrl.Config{Id: config.Id}}, make(chan interface{}, 1))
+  if exit := expectResponse(t, write, captain.Exit).Data.(*captain.ExitStatus); exit.ExitCode != 137 {
+    t.Errorf("Expected a stopped service to exit with 137, got %d", exit.ExitCode)
+  }
+}
+
+func TestServiceHealth(t *testing.T) {
+  c, fake := newTestCaptain(t)
+  config := newTestConfig()
+  config.Service = true
+  config.Healthcheck = &dockercntrl.Healthcheck{Command: []string{"true"}, StartPeriod: 1}
+  write := make(chan interface{}, 16)
+  go c.ExecuteConfig(config, write)
+  expectResponse(t, write, captain.Started)
+  health := func() string {
+    return expectResponse(t, write, captain.ServiceEvent).Data.(*captain.ServiceStatus).Event.Health
+  }
+  if got := health(); got != dockercntrl.HealthStarting {t.Errorf("Expected starting, got %q", got)}
+  task, _ := c.Tasks().Get(config.Id)
+
+  // unhealthy is held back during the start period, then released
+  fake.SetHealth(task.ContainerID, dockercntrl.HealthUnhealthy)
+  select {
+  case msg := <-write:
+    t.Errorf("Expected unhealthy to be held back, got %+v", msg)
+  case <-time.After(200 * time.Millisecond):
+  }
+  if got := health(); got != dockercntrl.HealthUnhealthy {t.Errorf("Expected unhealthy after the start period, got %q", got)}
+  fake.SetHealth(task.ContainerID, dockercntrl.HealthHealthy)
+  if got := health(); got != dockercntrl.HealthHealthy {t.Errorf("Expected healthy, got %q", got)}
+  if task, _ := c.Tasks().Get(config.Id); task.Health != dockercntrl.HealthHealthy {
+    t.Errorf("Expected the task to be healthy, got %+v", task)
+  }
+  c.ExecuteCommand(&captain.Message{Action: captain.Kill, Config: &dockercntrl.Config{Id: config.Id}}, make(chan interface{}, 1))
+  expectResponse(t, write, captain.Exit)
+}
+
+func TestTimeout(t *testing.T) {
+  c, fake := newTestCaptain(t)
+  fake.Output = "partial"
+  fake.Hang = true
+  config := newTestConfig()
+  config.Timeout = 1
+  write := make(chan interface{}, 1)
+  start := time.Now()
+  c.ExecuteConfig(config, write)
+  if elapsed := time.Since(start); elapsed < time.Second {t.Errorf("Task stopped early, after %v", elapsed)}
+  failure := expectFailure(t, write, captain.StageTimeout, 137)
+  if failure.Output != "partial" {t.Errorf("Expected the partial logs, got %q", failure.Output)}
+  if task, _ := c.Tasks().Get(config.Id); task.State != captain.TaskTimedOut {
+    t.Errorf("Expected the task to be timed out, got %+v", task)
+  }
+
+  expired := newTestConfig()
+  deadline := time.Now().Add(-time.Minute)
+  expired.Deadline = &deadline
+  c.ExecuteConfig(expired, write)
+  expectFailure(t, write, captain.StageTimeout, 0)
+  if task, _ := c.Tasks().Get(expired.Id); task.ContainerID != "" {t.Errorf("Expected no container for an expired task")}
+}
+
+func TestAdminAPI(t *testing.T) {
+  c, fake := newTestCaptain(t)
+  fake.Output = "hello\n"
+  fake.Hang = true
+  config := newTestConfig()
+  go c.ExecuteConfig(config, make(chan interface{}, 1))
+  server := httptest.NewServer(c.AdminHandler())
+  defer server.Close()
+
+  get := func(path string, status int, data interface{}) {
+    res, err := http.Get(server.URL + path)
+    if err != nil {t.Fatal(err)}
+    defer res.Body.Close()
+    if res.StatusCode != status {t.Fatalf("GET %s = %d, want %d", path, res.StatusCode, status)}
+    if err := json.NewDecoder(res.Body).Decode(data); err != nil {t.Fatal(err)}
+  }
+  var task captain.Task
+  for deadline := time.Now().Add(2 * time.Second); task.State != captain.TaskRunning; {
+    if time.Now().After(deadline) {t.Fatalf("Task never ran: %+v", task)}
+    get("/tasks/" + config.Id.String(), http.StatusOK, &task)
+  }
+  var tasks []captain.Task
+  get("/tasks", http.StatusOK, &tasks)
+  if len(tasks) != 1 || tasks[0].Id != *config.Id {t.Errorf("Unexpected tasks %+v", tasks)}
+  var logs dockercntrl.Logs
+  get("/tasks/" + config.Id.String() + "/logs", http.StatusOK, &logs)
+  if logs.Stdout != "hello" {t.Errorf("Stdout = %q, want %q", logs.Stdout, "hello")}
+  var status captain.NodeStatus
+  get("/node", http.StatusOK, &status)
+  if status.Name != "captain-test" || status.RunningTasks != 1 {t.Errorf("Unexpected node status %+v", status)}
+  var spinner captain.SpinnerStatus
+  get("/spinner", http.StatusOK, &spinner)
+  if spinner.Connected {t.Errorf("Expected no spinner connection, got %+v", spinner)}
+  var missing map[string]string
+  get("/tasks/" + uuid.New().String(), http.StatusNotFound, &missing)
+  get("/tasks/nope", http.StatusBadRequest, &missing)
+
+  post := func(path string, status int) *captain.CommandAck {
+    res, err := http.Post(server.URL + path, "application/json", nil)
+    if err != nil {t.Fatal(err)}
+    defer res.Body.Close()
+    var ack captain.CommandAck
+    if err := json.NewDecoder(res.Body).Decode(&ack); err != nil {t.Fatal(err)}
+    if res.StatusCode != status {t.Errorf("POST %s = %d, want %d: %+v", path, res.StatusCode, status, ack)}
+    return &ack
+  }
+  post("/tasks/" + uuid.New().String() + "/kill", http.StatusNotFound)
+  post("/tasks/" + config.Id.String() + "/logs", http.StatusBadRequest)
+  post("/tasks/" + config.Id.String() + "/pause", http.StatusBadRequest)
+  if ack := post("/tasks/" + config.Id.String() + "/kill", http.StatusOK); !ack.Ok {t.Errorf("Unexpected ack %+v", ack)}
+  inspection, err := fake.Inspect(&dockercntrl.Container{ID: task.ContainerID})
+  if err != nil || inspection.Running {t.Errorf("Expected the task to be killed, got %+v", inspection)}
+}
+
+func TestMetrics(t *testing.T) {
+  c, fake := newTestCaptain(t)
+  fake.PullTime = 3 * time.Second
+  fake.Usage = dockercntrl.Stats{CPUSeconds: 1.5, MemoryUsage: 1 << 20, MemoryLimit: 1 << 30}
+  c.ExecuteConfig(newTestConfig(), make(chan interface{}, 1))
+  fake.ExitCode = 2
+  c.ExecuteConfig(newTestConfig(), make(chan interface{}, 1))
+  fake.ExitCode = 0
+  fake.Hang = true
+  config := newTestConfig()
+  go c.ExecuteConfig(config, make(chan interface{}, 1))
+  for deadline := time.Now().Add(2 * time.Second); ; {
+    if task, _ := c.Tasks().Get(config.Id); task.State == captain.TaskRunning {break}
+    if time.Now().After(deadline) {t.Fatal("Task never ran")}
+    time.Sleep(10 * time.Millisecond)
+  }
+
+  server := httptest.NewServer(c.AdminHandler())
+  defer server.Close()
+  res, err := http.Get(server.URL + "/metrics")
+  if err != nil {t.Fatal(err)}
+  defer res.Body.Close()
+  body, err := ioutil.ReadAll(res.Body)
+  if err != nil {t.Fatal(err)}
+  task, _ := c.Tasks().Get(config.Id)
+  labels := `{nebula_id="` + config.Id.String() + `",container_id="` + task.ContainerID + `"}`
+  for _, line := range []string{
+    "# TYPE captain_tasks_received_total counter",
+    "captain_tasks_received_total 3",
+    "captain_tasks_succeeded_total 1",
+    `captain_tasks_failed_total{stage="wait"} 1`,
+    `captain_image_pull_duration_seconds_bucket{le="2.5"} 0`,
+    `captain_image_pull_duration_seconds_bucket{le="5"} 3`,
+    "captain_image_pull_duration_seconds_sum 9",
+    `captain_task_runtime_seconds_bucket{le="+Inf"} 2`,
+    "captain_spinner_connected 0",
+    "captain_running_tasks 1",
+    "captain_container_cpu_seconds_total" + labels + " 1.5",
+    "captain_container_memory_usage_bytes" + labels + " 1.048576e+06",
+  } {
+    if !strings.Contains(string(body), line + "\n") {t.Errorf("Metrics missing %q:\n%s", line, body)}
+  }
+}
+
+func TestMetricsFetchStatsConcurrently(t *testing.T) {
+  c, fake := newTestCaptain(t)
+  fake.Hang = true
+  fake.StatsTime = 300 * time.Millisecond
+  configs := []*dockercntrl.Config{newTestConfig(), newTestConfig(), newTestConfig()}
+  for _, config := range configs {
+    go c.ExecuteConfig(config, make(chan interface{}, 1))
+  }
+  for deadline := time.Now().Add(2 * time.Second); ; {
+    running := 0
+    for _, config := range configs {
+      if task, _ := c.Tasks().Get(config.Id); task.State == captain.TaskRunning {running++}
+    }
+    if running == len(configs) {break}
+    if time.Now().After(deadline) {t.Fatal("Tasks never ran")}
+    time.Sleep(10 * time.Millisecond)
+  }
+
+  var body strings.Builder
+  began := time.Now()
+  c.WriteMetrics(&body)
+  if took := time.Since(began); took >= 2 * fake.StatsTime {
+    t.Errorf("Stats of %d containers took %v, expected them fetched at once", len(configs), took)
+  }
+  if n := strings.Count(body.String(), "captain_container_memory_limit_bytes{"); n != len(configs) {
+    t.Errorf("Expected the memory limit of %d containers, got %d", len(configs), n)
+  }
+}
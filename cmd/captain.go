@@ -2,18 +2,84 @@ package main
 
 import (
   "github.com/armadanet/captain"
+  "github.com/armadanet/captain/dockercntrl"
+  "github.com/docker/go-units"
   "strconv"
   "os"
+  "os/signal"
+  "syscall"
+  "context"
 )
 
 func main() {
 
-  cap, err := captain.New(os.Args[2])
+  state, err := dockercntrl.New()
+  if err != nil {panic(err)}
+
+  // optional registry credentials, in docker config.json format
+  if path := os.Getenv("REGISTRY_AUTH_FILE"); path != "" {
+    state.Credentials, err = dockercntrl.LoadCredentials(path)
+    if err != nil {panic(err)}
+  }
+  // optional allow-list of images tasks may run
+  if path := os.Getenv("IMAGE_POLICY"); path != "" {
+    state.Policy, err = dockercntrl.LoadPolicy(path)
+    if err != nil {panic(err)}
+  }
+  // optional hardened baseline forced on every task
+  if path := os.Getenv("SECURITY_POLICY"); path != "" {
+    state.Hardening, err = dockercntrl.LoadSecurityPolicy(path)
+    if err != nil {panic(err)}
+  }
+
+  cap, err := captain.New(os.Args[2], state)
   if err != nil {panic(err)}
 
   selfSpin, err := strconv.ParseBool(os.Getenv("SELFSPIN"))
   if err != nil {panic(err)}
 
+  // optional ceiling on what the volunteer contributes, e.g.
+  // CONTRIBUTE_CPUS=2 CONTRIBUTE_MEMORY=4g
+  var contribution captain.Contribution
+  if cpus := os.Getenv("CONTRIBUTE_CPUS"); cpus != "" {
+    contribution.CPUs, err = strconv.ParseFloat(cpus, 64)
+    if err != nil {panic(err)}
+  }
+  if memory := os.Getenv("CONTRIBUTE_MEMORY"); memory != "" {
+    contribution.Memory, err = units.RAMInBytes(memory)
+    if err != nil {panic(err)}
+  }
+  cap.SetContribution(contribution)
+
+  // optional disk budget for images the captain pulls, e.g. IMAGE_BUDGET=10g
+  if budget := os.Getenv("IMAGE_BUDGET"); budget != "" {
+    bytes, err := units.RAMInBytes(budget)
+    if err != nil {panic(err)}
+    cap.SetImageBudget(bytes)
+  }
+
+  // optional retention of finished task containers, one of none,
+  // failed, last:<count> or for:<duration>, e.g. CONTAINER_RETENTION=for:24h
+  retention, err := captain.ParseRetention(os.Getenv("CONTAINER_RETENTION"))
+  if err != nil {panic(err)}
+  cap.SetRetention(retention)
+
+  // local admin API, e.g. ADMIN_ADDR=127.0.0.1:9998, or none
+  admin := os.Getenv("ADMIN_ADDR")
+  if admin == "" {admin = captain.AdminAddress}
+  if admin != "none" {
+    if err := cap.ServeAdmin(admin); err != nil {panic(err)}
+  }
+
+  // stop the captain cleanly on SIGINT/SIGTERM
+  ctx, cancel := context.WithCancel(context.Background())
+  signals := make(chan os.Signal, 1)
+  signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+  go func() {
+    <-signals
+    cancel()
+  }()
+
   // (1) beacon query url, (2) if selfSpin
-  cap.Run(os.Args[1], selfSpin)
+  cap.Run(ctx, os.Args[1], selfSpin)
 }
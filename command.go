@@ -0,0 +1,92 @@
+package captain
+
+import (
+  "github.com/armadanet/captain/dockercntrl"
+  "github.com/armadanet/spinner/spinresp"
+  "github.com/google/uuid"
+  "errors"
+  "fmt"
+  "log"
+)
+
+// Actions the spinner can request on a task it has sent.
+const (
+  Cancel  = "cancel"  // stop the task gracefully
+  Kill    = "kill"    // end the task immediately
+  Remove  = "remove"  // end the task and delete its container
+)
+
+// Message is read from the spinner socket. Without an Action it
+// is a task to run, exactly as a bare Config used to be. With an
+// Action, the action applies to the task whose nebula_id is given:
+//   {"action": "kill", "nebula_id": "<task id>"}
+type Message struct {
+  Action  string  `json:"action,omitempty"`
+  *dockercntrl.Config
+}
+
+// UnknownAction is returned for an action the captain does not know.
+type UnknownAction struct {
+  Action  string
+}
+
+func (e *UnknownAction) Error() string {
+  return fmt.Sprintf("Unknown action %q", e.Action)
+}
+
+// CommandAck is the Data of an Ack response, sent once a command
+// has been carried out (Ok) or has failed (Error).
+type CommandAck struct {
+  Action  string  `json:"action"`
+  Ok      bool    `json:"ok"`
+  Error   string  `json:"error,omitempty"`
+}
+
+// Carries out a command from the spinner and acknowledges it.
+func (c *Captain) ExecuteCommand(message *Message, write chan interface{}) {
+  err := c.command(message)
+  ack := &CommandAck{Action: message.Action, Ok: err == nil}
+  if err != nil {
+    log.Println(err)
+    ack.Error = err.Error()
+  }
+  var res spinresp.Response
+  res.Code = Ack
+  res.Data = ack
+  if message.Config != nil {res.Id = message.Config.Id}
+  c.send(write, &res)
+}
+
+func (c *Captain) command(message *Message) error {
+  if message.Config == nil || message.Config.Id == nil {
+    return errors.New("No task id given")
+  }
+  switch message.Action {
+  case Cancel, Kill, Remove:
+  default:
+    return &UnknownAction{Action: message.Action}
+  }
+  container, err := c.container(message.Config.Id)
+  if err != nil {return err}
+  switch message.Action {
+  case Cancel:
+    return c.state.Stop(container)
+  case Kill:
+    return c.state.Kill(container)
+  }
+  err = c.state.Remove(container)
+  if err == nil {c.tasks.Delete(message.Config.Id)}
+  return err
+}
+
+// Returns the container running a task, from the registry when the
+// task is tracked and otherwise from the runtime's labels.
+func (c *Captain) container(id *uuid.UUID) (*dockercntrl.Container, error) {
+  if task, ok := c.tasks.Get(id); ok {
+    if task.ContainerID == "" {
+      return nil, fmt.Errorf("Task %s is still %s", id, task.State)
+    }
+    return &dockercntrl.Container{ID: task.ContainerID}, nil
+  }
+  return c.state.Find(id)
+}
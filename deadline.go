@@ -0,0 +1,84 @@
+package captain
+
+import (
+  "log"
+  "fmt"
+  "errors"
+  "time"
+  "github.com/armadanet/captain/dockercntrl"
+)
+
+// Stage at which a task fails when it runs past its timeout or deadline.
+const StageTimeout = "timeout"
+
+// Returns when a task must have finished by, given when it started:
+// the earlier of its deadline and its timeout. Zero for never.
+func taskDeadline(config *dockercntrl.Config, started time.Time) time.Time {
+  var deadline time.Time
+  if config.Timeout > 0 {deadline = started.Add(time.Duration(config.Timeout) * time.Second)}
+  if config.Deadline != nil && (deadline.IsZero() || config.Deadline.Before(deadline)) {
+    deadline = *config.Deadline
+  }
+  return deadline
+}
+
+// Watches a started task, stopping its container once it passes its
+// deadline and killing it should it fail to stop. The returned function
+// ends the watch once the task has exited, reporting whether the task
+// was stopped for running out of time: only if a stop went through and
+// the container had not finished before it was issued, so a task that
+// exits as its deadline passes is not reported as timed out.
+func (c *Captain) enforceDeadline(config *dockercntrl.Config, container *dockercntrl.Container) func() bool {
+  deadline := taskDeadline(config, time.Now())
+  if deadline.IsZero() {return func() bool {return false}}
+  done := make(chan interface{})
+  stopped := make(chan time.Time, 1)
+  go func() {
+    defer close(stopped)
+    timer := time.NewTimer(time.Until(deadline))
+    defer timer.Stop()
+    select {
+    case <-timer.C:
+    case <-done:
+      return
+    }
+    log.Println("Task", config.Id, "ran past its deadline, stopping it")
+    issued := time.Now()
+    // stopping sends SIGTERM, and SIGKILL after the daemon's grace period
+    if err := c.state.Stop(container); err != nil {
+      log.Println(err)
+      if err := c.state.Kill(container); err != nil {
+        log.Println(err)
+        return
+      }
+    }
+    stopped <- issued
+  }()
+  return func() bool {
+    close(done)
+    issued, ok := <-stopped
+    if !ok {return false}
+    inspection, err := c.state.Inspect(container)
+    if err != nil {
+      log.Println(err)
+      return true
+    }
+    return inspection.FinishedAt.IsZero() || !inspection.FinishedAt.Before(issued)
+  }
+}
+
+// Error for a task that ran out of time, having exited with code.
+func timeoutError(config *dockercntrl.Config, code int64) error {
+  err := fmt.Errorf("task exceeded its %ds timeout", config.Timeout)
+  if config.Deadline != nil && (config.Timeout == 0 || time.Now().After(*config.Deadline)) {
+    err = fmt.Errorf("task exceeded its deadline %s", config.Deadline.Format(time.RFC3339))
+  }
+  return &dockercntrl.TaskError{Stage: StageTimeout, ExitCode: code, Err: err}
+}
+
+// Returns the exit code a runtime error carries, if any.
+func exitCode(err error) int64 {
+  var taskErr *dockercntrl.TaskError
+  if errors.As(err, &taskErr) {return taskErr.ExitCode}
+  return 0
+}
@@ -0,0 +1,36 @@
+package captain
+
+import (
+  "github.com/armadanet/captain/dockercntrl"
+  "github.com/google/uuid"
+  "testing"
+  "time"
+)
+
+// A task that exits just before its deadline passes is not reported as
+// timed out, though its container is stopped once the timer fires.
+func TestDeadlineRacesExit(t *testing.T) {
+  fake := dockercntrl.NewFake()
+  c, err := New("captain-test", fake)
+  if err != nil {t.Fatal(err)}
+  start := func() (*dockercntrl.Config, *dockercntrl.Container) {
+    id := uuid.New()
+    deadline := time.Now().Add(50 * time.Millisecond)
+    config := &dockercntrl.Config{Id: &id, Image: "alpine", Deadline: &deadline}
+    container, err := fake.Create(config)
+    if err != nil {t.Fatal(err)}
+    if err := fake.Start(container); err != nil {t.Fatal(err)}
+    return config, container
+  }
+
+  config, container := start()
+  timedOut := c.enforceDeadline(config, container)
+  if err := fake.Exit(container.ID, 0); err != nil {t.Fatal(err)}
+  time.Sleep(100 * time.Millisecond)
+  if timedOut() {t.Errorf("Expected a task that exited before its deadline not to time out")}
+
+  config, container = start()
+  timedOut = c.enforceDeadline(config, container)
+  time.Sleep(100 * time.Millisecond)
+  if !timedOut() {t.Errorf("Expected a task stopped at its deadline to time out")}
+}
@@ -1,33 +1,226 @@
 package captain
 
 import (
-  "github.com/armadanet/captain/dockercntrl"
   "github.com/armadanet/comms"
   "log"
+  "sync"
+  "time"
 )
 
-// Dial a socket connection to a given url. Listen for reads and writes
+const (
+  // Redials of the same spinner before asking the beacon for another.
+  RedialAttempts  = 5
+  // Wait before the first redial, doubled after every failure.
+  RedialDelay     = 1 * time.Second
+  MaxRedialDelay  = 30 * time.Second
+)
+
+// The timings links use, which tests shorten.
+var (
+  heartbeatPeriod = HeartbeatPeriod
+  writeDeadline   = comms.WriteDeadline
+  redialDelay     = RedialDelay
+)
+
+// link is an open socket to a spinner. The comms socket gives no
+// notice when its connection drops, and never closes its reader, so a
+// link is considered closed once a write is not taken within
+// writeDeadline. The last write taken before then may have been lost
+// with the connection.
+type link struct {
+  url     string
+  socket  comms.Socket
+  closed  chan interface{}
+  once    sync.Once
+}
+
+// Reports whether the link is still open.
+func (l *link) alive() bool {
+  select {
+  case <- l.closed:
+    return false
+  default:
+    return true
+  }
+}
+
+func (l *link) close() {
+  l.once.Do(func() {
+    close(l.closed)
+    l.socket.Close()
+  })
+}
+
+// Sends data over the link, closing the link if it cannot be sent.
+func (l *link) send(data interface{}) bool {
+  select {
+  case l.socket.Writer() <- data:
+    return true
+  case <- l.closed:
+  case <- time.After(writeDeadline):
+    log.Println("Spinner socket stopped accepting writes.")
+    l.close()
+  }
+  return false
+}
+
+// Dial a socket connection to a given url. Listen for reads and writes,
+// redialing if the connection drops.
 func (c *Captain) Dial(dailurl string) error {
-  socket, err := comms.EstablishSocket(dailurl)
+  l, err := c.open(dailurl)
   if err != nil {return err}
-  var config dockercntrl.Config
-  socket.Start(config)
-  go c.connect(socket.Reader(), socket.Writer())
+  go c.maintain(l)
   return nil
 }
 
-// Read in a container config from the socket and write the
-// execution output back. Should be adjusted for logging.
-func (c *Captain) connect(read chan interface{}, write chan interface{}) {
+// Opens a link to a spinner and starts reading from it.
+func (c *Captain) open(dailurl string) (*link, error) {
+  socket, err := comms.EstablishSocket(dailurl)
+  if err != nil {return nil, err}
+  var message Message
+  socket.Start(message)
+  l := &link{url: dailurl, socket: socket, closed: make(chan interface{})}
+  go c.connect(l)
+  return l, nil
+}
+
+// Keeps the captain connected to a spinner, forwarding writes over the
+// current link and replacing the link whenever it closes. Writes that
+// could not be sent, or may have been lost with the link, are sent
+// again over the next one, so the spinner may see a response twice.
+// Returns once the captain has stopped.
+func (c *Captain) maintain(l *link) {
+  var pending []interface{}
+  defer c.setLink(nil)
+  for {
+    c.setLink(l)
+    pending = c.forward(l, pending)
+    select {
+    case <- c.stopped:
+      l.close()
+      return
+    default:
+    }
+    log.Println("Lost connection to spinner at", l.url)
+    if l = c.redial(l.url); l == nil {return}
+    c.metrics.reconnected()
+  }
+}
+
+// Records the link the captain is currently using.
+func (c *Captain) setLink(l *link) {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  c.link = l
+}
+
+// Forwards writes from the captain's tasks over a link until it closes,
+// returning the writes still to be sent: those that could not be, after
+// the last one taken unless a heartbeat has been taken since. Heartbeats
+// are sent every HeartbeatPeriod, which also finds an idle link to be
+// closed.
+func (c *Captain) forward(l *link, pending []interface{}) []interface{} {
+  ticker := time.NewTicker(heartbeatPeriod)
+  defer ticker.Stop()
+  var last interface{}
+  for {
+    for len(pending) > 0 {
+      if !l.send(pending[0]) {return unconfirmed(last, pending)}
+      last, pending = pending[0], pending[1:]
+    }
+    select {
+    case data := <- c.write:
+      pending = append(pending, data)
+    case <- ticker.C:
+      if !l.send(c.heartbeat()) {return unconfirmed(last, pending)}
+      last = nil
+    case <- l.closed:
+      return unconfirmed(last, pending)
+    case <- c.stopped:
+      return nil
+    }
+  }
+}
+
+// Puts a write that may have been lost ahead of those still pending.
+func unconfirmed(last interface{}, pending []interface{}) []interface{} {
+  if last == nil {return pending}
+  return append([]interface{}{last}, pending...)
+}
+
+// Redials the spinner at url with exponential backoff. After
+// RedialAttempts failures the beacon is queried for a spinner to join
+// instead, unless the captain is shutting down, when only the same
+// spinner is redialed so draining tasks can still report. Returns nil
+// once the captain has stopped.
+func (c *Captain) redial(url string) *link {
+  delay := redialDelay
+  failures := 0
+  for {
+    select {
+    case <- time.After(delay):
+    case <- c.stopped:
+      return nil
+    }
+    if delay *= 2; delay > MaxRedialDelay {delay = MaxRedialDelay}
+    if failures >= RedialAttempts && !c.exiting() {
+      log.Println("Querying beacon for a new spinner...")
+      failures = 0
+      spinner_name, err := c.requery()
+      if err != nil {
+        log.Println(err)
+        continue
+      }
+      url = spinnerURL(spinner_name)
+    }
+    l, err := c.open(url)
+    if err == nil {
+      log.Println("Reconnected to spinner at", url)
+      return l
+    }
+    log.Println(err)
+    failures++
+  }
+}
+
+// Asks the beacon for a spinner after losing the previous one. The
+// captain leaves its old swarm first so that it can join a new one;
+// a self-spun spinner shares the local swarm, and is replaced by
+// SelfSpin.
+func (c *Captain) requery() (string, error) {
+  if !c.selfSpin {
+    if err := c.state.LeaveSwarm(); err != nil {return "", err}
+  }
+  return c.QueryBeacon(c.beaconURL, c.selfSpin)
+}
+
+// Read in a container config or a command from the socket and
+// write the execution output back. Stops reading once the link
+// closes or the captain shuts down. Should be adjusted for logging.
+func (c *Captain) connect(l *link) {
+  read := l.socket.Reader()
   for {
     select {
     case data, ok := <- read:
+      if !ok {
+        l.close()
+        return
+      }
+      message, ok := data.(*Message)
       if !ok {break}
-      config, ok := data.(*dockercntrl.Config)
-      if !ok {break}
+      if message.Action != "" {
+        log.Println("New Command Arrived:", message.Action)
+        go c.ExecuteCommand(message, c.write)
+        break
+      }
+      if message.Config == nil {break}
       log.Println("New Task Arrived:")
-      log.Println(config)
-      go c.ExecuteConfig(config, write)
+      log.Println(message.Config)
+      go c.ExecuteConfig(message.Config, c.write)
+    case <- l.closed:
+      return
+    case <- c.exit:
+      return
     }
   }
 }
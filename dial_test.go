@@ -0,0 +1,257 @@
+package captain
+
+import (
+  "github.com/armadanet/captain/dockercntrl"
+  "github.com/armadanet/comms"
+  "github.com/armadanet/spinner/spinresp"
+  "github.com/google/uuid"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "strings"
+  "sync"
+  "testing"
+  "time"
+)
+
+func init() {
+  heartbeatPeriod = 50 * time.Millisecond
+  writeDeadline = 200 * time.Millisecond
+  redialDelay = 50 * time.Millisecond
+}
+
+// spinnerServer stands in for a spinner, handing the test every link a
+// captain opens to it. While down it refuses them.
+type spinnerServer struct {
+  *httptest.Server
+  links   chan comms.Socket
+  refused chan struct{}
+  mu      sync.Mutex
+  down    bool
+}
+
+func newSpinnerServer() *spinnerServer {
+  s := &spinnerServer{links: make(chan comms.Socket, 1), refused: make(chan struct{}, 1)}
+  s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    s.mu.Lock()
+    down := s.down
+    s.mu.Unlock()
+    if down {
+      select {
+      case s.refused <- struct{}{}:
+      default:
+      }
+      http.Error(w, "spinner down", http.StatusServiceUnavailable)
+      return
+    }
+    socket, err := comms.AcceptSocket(w, r)
+    if err != nil {return}
+    socket.Start(spinresp.Response{})
+    s.links <- socket
+  }))
+  return s
+}
+
+func (s *spinnerServer) url() string {return "ws" + strings.TrimPrefix(s.URL, "http")}
+
+func (s *spinnerServer) setDown(down bool) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  s.down = down
+}
+
+// Waits for the captain to open a link.
+func (s *spinnerServer) accept(t *testing.T) comms.Socket {
+  select {
+  case socket := <- s.links:
+    return socket
+  case <- time.After(5 * time.Second):
+    t.Fatal("Captain did not open a link")
+  }
+  return nil
+}
+
+// Waits for the captain to be refused a link.
+func (s *spinnerServer) awaitRefusal(t *testing.T) {
+  select {
+  case <- s.refused:
+  case <- time.After(5 * time.Second):
+    t.Fatal("Captain did not redial")
+  }
+}
+
+// Sends a task over a link and waits for the captain's answer.
+func runTask(t *testing.T, socket comms.Socket) {
+  id := uuid.New()
+  socket.Writer() <- &Message{Config: &dockercntrl.Config{Id: &id, Image: "alpine", Cmd: []string{"true"}}}
+  timeout := time.After(5 * time.Second)
+  for {
+    select {
+    case data := <- socket.Reader():
+      res := data.(*spinresp.Response)
+      if res.Code == Heartbeat {continue}
+      if res.Id == nil || *res.Id != id || res.Code != spinresp.Success {
+        t.Fatalf("Expected task %s to succeed, got %+v", id, res)
+      }
+      return
+    case <- timeout:
+      t.Fatal("Captain did not answer the task")
+    }
+  }
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+  deadline := time.Now().Add(5 * time.Second)
+  for !cond() {
+    if time.Now().After(deadline) {t.Fatal("Timed out waiting for " + what)}
+    time.Sleep(10 * time.Millisecond)
+  }
+}
+
+func TestLinkRecovers(t *testing.T) {
+  spinner := newSpinnerServer()
+  defer spinner.Close()
+  c, err := New("captain-test", dockercntrl.NewFake())
+  if err != nil {t.Fatal(err)}
+  if err := c.Dial(spinner.url()); err != nil {t.Fatal(err)}
+  first := spinner.accept(t)
+  runTask(t, first)
+
+  // the spinner drops the link and refuses the first redial
+  spinner.setDown(true)
+  first.Close()
+  spinner.awaitRefusal(t)
+  if c.spinnerStatus().Connected {t.Errorf("Expected the dropped link to be closed")}
+  spinner.setDown(false)
+  second := spinner.accept(t)
+  runTask(t, second)
+  c.metrics.mu.Lock()
+  if c.metrics.reconnects != 1 {t.Errorf("Reconnects = %d, want 1", c.metrics.reconnects)}
+  c.metrics.mu.Unlock()
+  if status := c.spinnerStatus(); !status.Connected || status.URL != spinner.url() {
+    t.Errorf("Expected to be connected to %s, got %+v", spinner.url(), status)
+  }
+
+  // redialing stops once the captain shuts down
+  spinner.setDown(true)
+  second.Close()
+  spinner.awaitRefusal(t)
+  c.shutdown()
+  waitFor(t, "the captain to stop redialing", func() bool {return c.spinnerStatus().URL == ""})
+}
+
+func TestSelfSpinReplacesSpinner(t *testing.T) {
+  fake := dockercntrl.NewFake()
+  c, err := New("captain-test", fake)
+  if err != nil {t.Fatal(err)}
+  os.Setenv("SPINNER_NAME", "spinner-test")
+  defer os.Unsetenv("SPINNER_NAME")
+  old := &dockercntrl.Config{Image: "docker.io/geoffreyhl/spinner", Name: "spinner-test"}
+  old.SetSystem()
+  container, err := fake.Create(old)
+  if err != nil {t.Fatal(err)}
+  c.addSystem(container)
+
+  spun := make(chan error)
+  go func() {
+    _, _, err := c.SelfSpin()
+    spun <- err
+  }()
+  waitFor(t, "the old spinner to be removed", func() bool {
+    _, ok := fake.Container(container.ID)
+    return !ok
+  })
+  c.stop()
+  select {
+  case err := <- spun:
+    if err == nil {t.Errorf("Expected SelfSpin to give up on shutdown")}
+  case <- time.After(5 * time.Second):
+    t.Fatal("SelfSpin did not return on shutdown")
+  }
+}
+
+// Sends a response as one of the captain's tasks would.
+func respond(c *Captain) *uuid.UUID {
+  id := uuid.New()
+  go c.send(c.write, &spinresp.Response{Id: &id, Code: spinresp.Success})
+  return &id
+}
+
+func TestLinkResendsLostResponse(t *testing.T) {
+  // no heartbeat finds the dropped link first
+  heartbeatPeriod = time.Hour
+  defer func() {heartbeatPeriod = 50 * time.Millisecond}()
+  spinner := newSpinnerServer()
+  defer spinner.Close()
+  c, err := New("captain-test", dockercntrl.NewFake())
+  if err != nil {t.Fatal(err)}
+  if err := c.Dial(spinner.url()); err != nil {t.Fatal(err)}
+  defer c.shutdown()
+  first := spinner.accept(t)
+
+  spinner.setDown(true)
+  first.Close()
+  time.Sleep(100 * time.Millisecond)
+  // the dying socket takes the first response and loses it, the second
+  // is never taken and closes the link
+  lost := respond(c)
+  time.Sleep(50 * time.Millisecond)
+  blocked := respond(c)
+  spinner.awaitRefusal(t)
+  spinner.setDown(false)
+  second := spinner.accept(t)
+  for _, id := range []*uuid.UUID{lost, blocked} {
+    select {
+    case data := <- second.Reader():
+      if res := data.(*spinresp.Response); res.Id == nil || *res.Id != *id {
+        t.Errorf("Expected the response to %s, got %+v", id, res)
+      }
+    case <- time.After(5 * time.Second):
+      t.Fatalf("Response to %s was never sent again", id)
+    }
+  }
+}
+
+func TestShutdownRedialsForDrainingTasks(t *testing.T) {
+  spinner := newSpinnerServer()
+  defer spinner.Close()
+  fake := dockercntrl.NewFake()
+  fake.Hang = true
+  c, err := New("captain-test", fake)
+  if err != nil {t.Fatal(err)}
+  if err := c.Dial(spinner.url()); err != nil {t.Fatal(err)}
+  first := spinner.accept(t)
+  id := uuid.New()
+  first.Writer() <- &Message{Config: &dockercntrl.Config{Id: &id, Image: "alpine", Cmd: []string{"sleep", "1000"}}}
+  waitFor(t, "the task to run", func() bool {
+    task, _ := c.tasks.Get(&id)
+    return task.State == TaskRunning
+  })
+
+  done := make(chan struct{})
+  go func() {
+    c.shutdown()
+    close(done)
+  }()
+  waitFor(t, "the shutdown to begin", c.exiting)
+  // the link drops while the task drains, as on SIGINT
+  first.Close()
+  second := spinner.accept(t)
+  task, _ := c.tasks.Get(&id)
+  if err := fake.Exit(task.ContainerID, 0); err != nil {t.Fatal(err)}
+  timeout := time.After(5 * time.Second)
+  for reported := false; !reported; {
+    select {
+    case data := <- second.Reader():
+      res := data.(*spinresp.Response)
+      reported = res.Id != nil && *res.Id == id && res.Code == spinresp.Success
+    case <- timeout:
+      t.Fatal("Drained task did not report over the new link")
+    }
+  }
+  select {
+  case <- done:
+  case <- time.After(5 * time.Second):
+    t.Fatal("Captain did not stop once its task reported")
+  }
+}
@@ -0,0 +1,128 @@
+package dockercntrl
+
+import (
+  "github.com/docker/docker/api/types"
+  "encoding/base64"
+  "encoding/json"
+  "fmt"
+  "io/ioutil"
+  "strings"
+)
+
+const (
+  // Registry of images without a registry host, and the key docker
+  // uses for it in config.json.
+  DefaultRegistry = "docker.io"
+  DefaultRegistryKey = "https://index.docker.io/v1/"
+)
+
+// RegistryAuth holds the credentials for pulling from a registry.
+type RegistryAuth struct {
+  Username        string  `json:"username,omitempty"`
+  Password        string  `json:"password,omitempty"`
+  IdentityToken   string  `json:"identitytoken,omitempty"`
+  ServerAddress   string  `json:"serveraddress,omitempty"`
+}
+
+// CredentialStore holds registry credentials kept on the captain,
+// keyed by registry host.
+type CredentialStore struct {
+  auths map[string]*RegistryAuth
+}
+
+// dockerConfig is the part of a docker config.json holding credentials.
+type dockerConfig struct {
+  Auths map[string]struct {
+    Auth          string  `json:"auth"`
+    Username      string  `json:"username"`
+    Password      string  `json:"password"`
+    IdentityToken string  `json:"identitytoken"`
+  } `json:"auths"`
+}
+
+// LoadCredentials reads a credential store from a file in the docker
+// config.json format.
+func LoadCredentials(path string) (*CredentialStore, error) {
+  body, err := ioutil.ReadFile(path)
+  if err != nil {return nil, err}
+  return ParseCredentials(body)
+}
+
+// ParseCredentials reads a credential store from the contents of a
+// docker config.json.
+func ParseCredentials(body []byte) (*CredentialStore, error) {
+  var config dockerConfig
+  if err := json.Unmarshal(body, &config); err != nil {return nil, err}
+  store := &CredentialStore{auths: make(map[string]*RegistryAuth)}
+  for key, entry := range config.Auths {
+    auth := &RegistryAuth{
+      Username: entry.Username,
+      Password: entry.Password,
+      IdentityToken: entry.IdentityToken,
+      ServerAddress: key,
+    }
+    if entry.Auth != "" {
+      decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+      if err != nil {return nil, fmt.Errorf("Invalid auth for %s: %v", key, err)}
+      parts := strings.SplitN(string(decoded), ":", 2)
+      if len(parts) != 2 {return nil, fmt.Errorf("Invalid auth for %s", key)}
+      auth.Username, auth.Password = parts[0], parts[1]
+    }
+    store.auths[registryHost(key)] = auth
+  }
+  return store, nil
+}
+
+// Lookup returns the credentials kept for a registry.
+func (s *CredentialStore) Lookup(registry string) (*RegistryAuth, bool) {
+  if s == nil {return nil, false}
+  auth, ok := s.auths[registryHost(registry)]
+  return auth, ok
+}
+
+// Reduces a registry key, which may be a url, to its host.
+func registryHost(key string) string {
+  key = strings.TrimPrefix(strings.TrimPrefix(key, "https://"), "http://")
+  key = strings.SplitN(key, "/", 2)[0]
+  if key == "index.docker.io" || key == "registry-1.docker.io" {return DefaultRegistry}
+  return key
+}
+
+// Returns the registry host an image reference pulls from.
+func imageRegistry(ref string) string {
+  parts := strings.SplitN(ref, "/", 2)
+  if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+    return registryHost(parts[0])
+  }
+  return DefaultRegistry
+}
+
+// Returns the encoded credentials to pull a config's image with: those
+// in the config, those its AuthRef names in the store, or those kept
+// for the image's registry. Returns "" when none apply. Stored
+// credentials are only ever sent to the registry they are kept for, so
+// an AuthRef naming another registry than the image's is refused.
+func registryAuth(config *Config, store *CredentialStore) (string, error) {
+  auth := config.Auth
+  if auth == nil && config.AuthRef != "" {
+    if registry := imageRegistry(config.Image); registryHost(config.AuthRef) != registry {
+      return "", fmt.Errorf("Credentials for %s cannot be used to pull from %s", config.AuthRef, registry)
+    }
+    found, ok := store.Lookup(config.AuthRef)
+    if !ok {return "", fmt.Errorf("No credentials for %s", config.AuthRef)}
+    auth = found
+  }
+  if auth == nil {
+    found, ok := store.Lookup(imageRegistry(config.Image))
+    if !ok {return "", nil}
+    auth = found
+  }
+  encoded, err := json.Marshal(types.AuthConfig{
+    Username: auth.Username,
+    Password: auth.Password,
+    IdentityToken: auth.IdentityToken,
+    ServerAddress: auth.ServerAddress,
+  })
+  if err != nil {return "", err}
+  return base64.URLEncoding.EncodeToString(encoded), nil
+}
@@ -0,0 +1,60 @@
+package dockercntrl
+
+import (
+  "encoding/base64"
+  "encoding/json"
+  "testing"
+  "github.com/docker/docker/api/types"
+)
+
+func decodeAuth(t *testing.T, encoded string) types.AuthConfig {
+  var auth types.AuthConfig
+  body, err := base64.URLEncoding.DecodeString(encoded)
+  if err != nil {t.Fatal(err)}
+  if err := json.Unmarshal(body, &auth); err != nil {t.Fatal(err)}
+  return auth
+}
+
+func TestRegistryAuth(t *testing.T) {
+  store, err := ParseCredentials([]byte(`{"auths": {
+    "https://index.docker.io/v1/": {"auth": "` + base64.StdEncoding.EncodeToString([]byte("hub:secret")) + `"},
+    "registry.example.com": {"auth": "` + base64.StdEncoding.EncodeToString([]byte("team:pa:ss")) + `"}
+  }}`))
+  if err != nil {t.Fatal(err)}
+
+  encoded, err := registryAuth(&Config{Image: "registry.example.com/team/app:1.0"}, store)
+  if err != nil {t.Fatal(err)}
+  if auth := decodeAuth(t, encoded); auth.Username != "team" || auth.Password != "pa:ss" {
+    t.Errorf("Unexpected credentials for private registry %+v", auth)
+  }
+
+  encoded, err = registryAuth(&Config{Image: "team/app"}, store)
+  if err != nil {t.Fatal(err)}
+  if auth := decodeAuth(t, encoded); auth.Username != "hub" {
+    t.Errorf("Unexpected credentials for docker hub %+v", auth)
+  }
+
+  encoded, err = registryAuth(&Config{Image: "registry.example.com/team/app", AuthRef: "https://registry.example.com/v2/"}, store)
+  if err != nil {t.Fatal(err)}
+  if auth := decodeAuth(t, encoded); auth.Username != "team" {
+    t.Errorf("AuthRef not used %+v", auth)
+  }
+  for _, image := range []string{"team/app", "evil.example.org/x"} {
+    if encoded, err := registryAuth(&Config{Image: image, AuthRef: "registry.example.com"}, store); err == nil || encoded != "" {
+      t.Errorf("Expected credentials for registry.example.com to be refused for %s", image)
+    }
+  }
+
+  encoded, err = registryAuth(&Config{Image: "team/app", Auth: &RegistryAuth{Username: "own"}}, store)
+  if err != nil {t.Fatal(err)}
+  if auth := decodeAuth(t, encoded); auth.Username != "own" {
+    t.Errorf("Config credentials not used %+v", auth)
+  }
+
+  if _, err := registryAuth(&Config{Image: "missing.example.com/app", AuthRef: "missing.example.com"}, store); err == nil {
+    t.Errorf("Expected an error for a missing credential reference")
+  }
+  if encoded, _ := registryAuth(&Config{Image: "quay.io/team/app"}, store); encoded != "" {
+    t.Errorf("Expected no credentials for an unknown registry")
+  }
+}
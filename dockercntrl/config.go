@@ -3,88 +3,178 @@ package dockercntrl
 import (
   "github.com/docker/docker/api/types/container"
   "github.com/docker/docker/api/types/mount"
-  "github.com/docker/go-connections/nat"
-  "github.com/phayes/freeport"
   "github.com/google/uuid"
-  "strconv"
+  "github.com/docker/go-units"
+  "regexp"
+  "time"
+  "errors"
+  "fmt"
 )
 
-// Limits hold the set of limits for a given container.
+// Limits hold the set of limits for a given container. Zero values
+// leave a limit unset.
 type Limits struct {
-  CPUShares int64     `json:"cpushares"`
+  CPUShares   int64       `json:"cpushares"`
+  Memory      int64       `json:"memory"`      // bytes
+  MemorySwap  int64       `json:"memoryswap"`  // memory plus swap in bytes, -1 for unlimited swap
+  NanoCPUs    int64       `json:"nanocpus"`    // CPU quota in units of 10^-9 CPUs
+  CpusetCpus  string      `json:"cpusetcpus"`  // CPUs to pin to, e.g. "0-2" or "0,1"
+  PidsLimit   int64       `json:"pidslimit"`   // -1 for unlimited
+  BlkioWeight uint16      `json:"blkioweight"` // 10 to 1000
+  Ulimits     []*Ulimit   `json:"ulimits"`
 }
 
-// Config represents the configuration to build a new container.
-type Config struct {
-  Id        *uuid.UUID  `json:"nebula_id,omitempty"`
-  Image     string      `json:"image"`
-  Cmd       []string    `json:"command"`
-  Tty       bool        `json:"tty"`
-  Name      string      `json:"name"`
-  Limits    *Limits     `json:"limits"`
-  Env       []string    `json:"env"`
-  Port      int         `json:"port"`
-  Storage   bool        `json:"storage"`
-  mounts    []mount.Mount
+// Ulimit is a resource limit set on the processes in a container.
+type Ulimit struct {
+  Name  string  `json:"name"`
+  Soft  int64   `json:"soft"`
+  Hard  int64   `json:"hard"`
 }
 
 const (
-  LABEL = "nebula-id"
+  // Smallest memory limit docker accepts.
+  MinMemory = 4 * 1024 * 1024
 )
 
-func (c *Config) AddMount(name string) {
-  c.mounts = []mount.Mount{
-    {
-      Type: mount.TypeVolume,
-      Source: name,
-      Target: "/data",
-    },
+var cpusetFormat = regexp.MustCompile(`^[0-9]+(-[0-9]+)?(,[0-9]+(-[0-9]+)?)*$`)
+
+// Validate returns an error for limits docker would reject or
+// that cannot be meant, such as negative quotas.
+func (l *Limits) Validate() error {
+  if l == nil {return nil}
+  if l.CPUShares < 0 {return fmt.Errorf("Invalid cpushares %d", l.CPUShares)}
+  if l.Memory < 0 || (l.Memory > 0 && l.Memory < MinMemory) {
+    return fmt.Errorf("Invalid memory %d, must be at least %d bytes", l.Memory, MinMemory)
+  }
+  if l.MemorySwap < -1 {return fmt.Errorf("Invalid memoryswap %d", l.MemorySwap)}
+  if l.MemorySwap > 0 {
+    if l.Memory == 0 {return errors.New("memoryswap requires memory to be set")}
+    if l.MemorySwap < l.Memory {
+      return fmt.Errorf("memoryswap %d must be at least memory %d", l.MemorySwap, l.Memory)
+    }
   }
+  if l.NanoCPUs < 0 {return fmt.Errorf("Invalid nanocpus %d", l.NanoCPUs)}
+  if l.CpusetCpus != "" && !cpusetFormat.MatchString(l.CpusetCpus) {
+    return fmt.Errorf("Invalid cpusetcpus %q", l.CpusetCpus)
+  }
+  if l.PidsLimit < -1 {return fmt.Errorf("Invalid pidslimit %d", l.PidsLimit)}
+  if l.BlkioWeight != 0 && (l.BlkioWeight < 10 || l.BlkioWeight > 1000) {
+    return fmt.Errorf("Invalid blkioweight %d, must be between 10 and 1000", l.BlkioWeight)
+  }
+  for _, u := range l.Ulimits {
+    if u == nil || u.Name == "" {return errors.New("ulimit requires a name")}
+    if u.Hard >= 0 && u.Soft > u.Hard {
+      return fmt.Errorf("ulimit %s soft limit %d is above hard limit %d", u.Name, u.Soft, u.Hard)
+    }
+  }
+  return nil
 }
 
-func (c *Config) AddDeamonMount() {
-  c.mounts = []mount.Mount{
-    {
-      Type: mount.TypeBind,
-      Source: "/var/run/docker.sock",
-      Target: "/var/run/docker.sock",
-    },
+// Converts the limits into docker-go-sdk resources
+func (l *Limits) resources() container.Resources {
+  if l == nil {return container.Resources{}}
+  resources := container.Resources{
+    CPUShares: l.CPUShares,
+    Memory: l.Memory,
+    MemorySwap: l.MemorySwap,
+    NanoCPUs: l.NanoCPUs,
+    CpusetCpus: l.CpusetCpus,
+    PidsLimit: l.PidsLimit,
+    BlkioWeight: l.BlkioWeight,
+  }
+  for _, u := range l.Ulimits {
+    resources.Ulimits = append(resources.Ulimits, &units.Ulimit{Name: u.Name, Soft: u.Soft, Hard: u.Hard})
   }
+  return resources
+}
+
+// Config represents the configuration to build a new container.
+type Config struct {
+  Id          *uuid.UUID     `json:"nebula_id,omitempty"`
+  Image       string         `json:"image"`
+  Cmd         []string       `json:"command"`
+  Tty         bool           `json:"tty"`
+  Name        string         `json:"name"`
+  Limits      *Limits        `json:"limits"`
+  Security    *Security      `json:"security,omitempty"`
+  Privileged  bool           `json:"privileged,omitempty"`  // only allowed for system containers
+  Env         []string       `json:"env"`
+  Port        int            `json:"port"`                // a tcp port, as the first of Ports
+  Ports       []*PortSpec    `json:"ports,omitempty"`
+  Storage     bool           `json:"storage"`
+  Stream      bool           `json:"stream"`
+  Service     bool           `json:"service,omitempty"`   // run until stopped rather than as a batch job
+  Restart     *RestartPolicy `json:"restart,omitempty"`   // services only
+  Healthcheck *Healthcheck   `json:"healthcheck,omitempty"`  // services only
+  Timeout     int            `json:"timeout,omitempty"`   // seconds the task may run for, 0 for no limit
+  Deadline    *time.Time     `json:"deadline,omitempty"`  // time by which the task must have finished
+  PullPolicy  string         `json:"pull_policy,omitempty"`
+  Auth        *RegistryAuth  `json:"auth,omitempty"`      // credentials for the image's registry
+  AuthRef     string         `json:"auth_ref,omitempty"`  // registry of the image whose credentials the captain holds
+  Digest      string         `json:"digest,omitempty"`    // required image digest, e.g. "sha256:..."
+  OnProgress  ProgressFunc   `json:"-"`                  // called with progress while pulling
+  Mounts      []*Mount       `json:"mounts,omitempty"`
+  OnStart     StartFunc      `json:"-"`                  // called once the container has started
+  OnPulled    PulledFunc     `json:"-"`                  // called once the image has been pulled
+  system      bool           // run by the captain itself, see SetSystem
+  scratch     string         // id of the container's scratch volumes
+}
+
+const (
+  LABEL = "nebula-id"
+)
+
+// Validate returns an error for a config that cannot be converted into
+// a container, so that it can be refused before its image is pulled.
+func (c *Config) Validate() error {
+  if err := c.Limits.Validate(); err != nil {return err}
+  if err := c.Security.Validate(); err != nil {return err}
+  if err := c.Restart.Validate(); err != nil {return err}
+  if c.Restart != nil && !c.Service {return errors.New("restart policy requires service mode")}
+  if err := c.Healthcheck.Validate(); err != nil {return err}
+  if c.Timeout < 0 {return fmt.Errorf("Invalid timeout %d", c.Timeout)}
+  if c.Healthcheck != nil && !c.Service {return errors.New("healthcheck requires service mode")}
+  if !validPullPolicy(c.PullPolicy) {return fmt.Errorf("Invalid pull policy %q", c.PullPolicy)}
+  _, _, err := c.ports()
+  return err
 }
 
 // Converts a dockercntrl.Config into the necessary docker-go-sdk configs
 func (c *Config) convert() (*container.Config, *container.HostConfig, error) {
   var id string
   if c.Id != nil {id = c.Id.String()}
+  if err := c.Validate(); err != nil {return nil, nil, err}
   config := &container.Config{
     Image: c.Image,
     Cmd: c.Cmd,
     Tty: c.Tty,
     Env: c.Env,
+    Healthcheck: c.Healthcheck.convert(),
     Labels: map[string]string{
       LABEL: id, // To identify as belonging to nebula
     },
   }
 
-  hostConfig := &container.HostConfig{
-    Resources: container.Resources{
-      CPUShares: c.Limits.CPUShares,
-    },
-    Mounts: c.mounts,
+  if c.scratch != "" {config.Labels[SCRATCH_LABEL] = c.scratch}
+  mounts := make([]mount.Mount, len(c.Mounts))
+  for i, m := range c.Mounts {
+    mounts[i] = m.convert()
   }
 
-  // If port is supplied, open that port on the container thru
-  // a random open port on the host machine.
-  if c.Port != 0 {
-    port, err := nat.NewPort("tcp", strconv.Itoa(c.Port))
-    if err != nil {return config, hostConfig, err}
-    config.ExposedPorts = nat.PortSet{port: struct{}{}}
-    openPort, err := freeport.GetFreePort()
-    if err != nil {return config, hostConfig, err}
-    hostConfig.PortBindings = nat.PortMap{
-      port: []nat.PortBinding{{HostIP: "0.0.0.0", HostPort: strconv.Itoa(openPort)}},
-    }
+  hostConfig := &container.HostConfig{
+    Resources: c.Limits.resources(),
+    Mounts: mounts,
+    Privileged: c.Privileged,
+    RestartPolicy: c.Restart.convert(),
   }
+  c.Security.apply(config, hostConfig)
+
+  // Publish the container's ports, on free host ports picked by
+  // docker unless the spec fixes one.
+  exposed, bindings, err := c.ports()
+  if err != nil {return config, hostConfig, err}
+  config.ExposedPorts = exposed
+  hostConfig.PortBindings = bindings
 
   return config, hostConfig, nil
 }
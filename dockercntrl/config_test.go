@@ -0,0 +1,227 @@
+package dockercntrl
+
+import (
+  "github.com/docker/docker/api/types/events"
+  "testing"
+)
+
+func TestLimitsValidate(t *testing.T) {
+  valid := []*Limits{
+    nil,
+    {},
+    {CPUShares: 4, Memory: 64 << 20, MemorySwap: 128 << 20, NanoCPUs: 5e8, CpusetCpus: "0-1,3", PidsLimit: 100, BlkioWeight: 500},
+    {Memory: 64 << 20, MemorySwap: -1, PidsLimit: -1},
+    {Ulimits: []*Ulimit{{Name: "nofile", Soft: 1024, Hard: 2048}}},
+  }
+  for _, l := range valid {
+    if err := l.Validate(); err != nil {t.Errorf("Expected %+v to be valid: %v", l, err)}
+  }
+  invalid := []*Limits{
+    {CPUShares: -1},
+    {Memory: 1024},
+    {MemorySwap: 128 << 20},
+    {Memory: 128 << 20, MemorySwap: 64 << 20},
+    {NanoCPUs: -5},
+    {CpusetCpus: "0-"},
+    {PidsLimit: -2},
+    {BlkioWeight: 5},
+    {Ulimits: []*Ulimit{{Name: "nofile", Soft: 4096, Hard: 1024}}},
+  }
+  for _, l := range invalid {
+    if err := l.Validate(); err == nil {t.Errorf("Expected %+v to be invalid", l)}
+  }
+}
+
+func TestConvertLimits(t *testing.T) {
+  config := &Config{
+    Image: "alpine",
+    Limits: &Limits{Memory: 64 << 20, NanoCPUs: 5e8, Ulimits: []*Ulimit{{Name: "nproc", Soft: 10, Hard: 20}}},
+  }
+  _, hostConfig, err := config.convert()
+  if err != nil {t.Fatal(err)}
+  if hostConfig.Memory != 64 << 20 || hostConfig.NanoCPUs != 5e8 {
+    t.Errorf("Limits not mapped into resources: %+v", hostConfig.Resources)
+  }
+  if len(hostConfig.Ulimits) != 1 || hostConfig.Ulimits[0].Name != "nproc" {
+    t.Errorf("Ulimits not mapped: %+v", hostConfig.Ulimits)
+  }
+
+  config.Limits = nil
+  if _, _, err := config.convert(); err != nil {t.Errorf("Config without limits failed: %v", err)}
+}
+
+func TestPullPolicyDefaults(t *testing.T) {
+  for image, policy := range map[string]string{
+    "alpine": PullAlways,
+    "alpine:latest": PullAlways,
+    "alpine:3.11": PullIfNotPresent,
+    "localhost:5000/alpine": PullAlways,
+    "localhost:5000/alpine:3.11": PullIfNotPresent,
+    "alpine@sha256:abc": PullIfNotPresent,
+  } {
+    if got := (&Config{Image: image}).pullPolicy(); got != policy {
+      t.Errorf("Policy for %s = %s, want %s", image, got, policy)
+    }
+  }
+  if got := (&Config{Image: "alpine", PullPolicy: PullNever}).pullPolicy(); got != PullNever {
+    t.Errorf("Explicit policy ignored, got %s", got)
+  }
+}
+
+func TestCheckMounts(t *testing.T) {
+  policy := &SecurityPolicy{AllowBinds: []string{"/srv/data"}}
+  task := &Config{Image: "alpine", Storage: true}
+  task.AddMount(CARGO_VOLUME)
+  task.Mounts = append(task.Mounts,
+    &Mount{Type: MountVolume, Source: TASK_VOLUME_PREFIX + "data", Target: "/shared"},
+    &Mount{Type: MountScratch, Target: "/scratch"},
+    &Mount{Type: MountTmpfs, Target: "/tmp", Size: 64 << 20},
+    &Mount{Type: MountBind, Source: "/srv/data/in", Target: "/in", ReadOnly: true},
+  )
+  if err := checkMounts(task, policy); err != nil {t.Errorf("Expected the mounts to be allowed: %v", err)}
+  if err := checkMounts(task, nil); err == nil {t.Errorf("Expected binds to be refused without a policy")}
+  task.AddDeamonMount()
+  if err := checkMounts(task, policy); err == nil {t.Errorf("Expected the docker socket to be refused")}
+  if err := checkMounts(&Config{Image: "alpine", Privileged: true}, policy); err == nil {
+    t.Errorf("Expected privileged mode to be refused")
+  }
+  for _, security := range []*Security{
+    {CapAdd: []string{"ALL"}},
+    {CapAdd: []string{"NET_ADMIN"}},
+    {Seccomp: Unconfined},
+    {AppArmor: Unconfined},
+  } {
+    if err := checkMounts(&Config{Image: "alpine", Security: security}, nil); err == nil {
+      t.Errorf("Expected %+v to be refused without a policy", *security)
+    }
+  }
+  for _, volume := range []*Config{
+    {Image: "alpine", Mounts: []*Mount{{Type: MountVolume, Source: CARGO_VOLUME, Target: "/cargo"}}},
+    {Image: "alpine", Mounts: []*Mount{{Type: MountVolume, Source: "postgres-data", Target: "/data"}}},
+    {Image: "alpine", Mounts: []*Mount{{Type: MountVolume, Source: SCRATCH_LABEL + "-other-0", Target: "/data"}}},
+  } {
+    if err := checkMounts(volume, policy); err == nil {
+      t.Errorf("Expected volume %s to be refused", volume.Mounts[0].Source)
+    }
+  }
+  lenient := &SecurityPolicy{AllowCaps: []string{"NET_ADMIN"}, AllowUnconfined: true}
+  if err := checkMounts(&Config{Image: "alpine", Security: &Security{CapAdd: []string{"NET_ADMIN"}, AppArmor: Unconfined}}, lenient); err != nil {
+    t.Errorf("Expected the policy to allow the capability and no AppArmor: %v", err)
+  }
+  for _, source := range []string{DockerSocket, "/var/run/", "/var", "/"} {
+    if !exposesSocket(source) {t.Errorf("Expected %s to expose the socket", source)}
+  }
+  if exposesSocket("/var/lib/data") {t.Errorf("Expected /var/lib/data not to expose the socket")}
+  for _, m := range []*Mount{
+    {Type: MountVolume, Target: "/data"},
+    {Type: MountBind, Source: "data", Target: "/data"},
+    {Type: MountScratch, Source: "named", Target: "/scratch"},
+    {Type: MountVolume, Source: "cargo", Target: "data"},
+    {Type: MountVolume, Source: "cargo", Target: "/data", Size: 1024},
+    {Type: "nfs", Source: "cargo", Target: "/data"},
+  } {
+    if err := m.Validate(); err == nil {t.Errorf("Expected %+v to be invalid", m)}
+  }
+
+  system := &Config{Image: "spinner", Privileged: true}
+  system.AddDeamonMount()
+  system.SetSystem()
+  if err := checkMounts(system, nil); err != nil {t.Errorf("Expected a system container to be allowed: %v", err)}
+}
+
+func TestConvertMounts(t *testing.T) {
+  config := &Config{Image: "alpine"}
+  config.AddMount("cargo")
+  config.Mounts = append(config.Mounts,
+    &Mount{Type: MountScratch, Target: "/scratch"},
+    &Mount{Type: MountTmpfs, Target: "/tmp", Size: 64 << 20},
+  )
+  prepared, scratch := config.withScratch("abc")
+  if len(scratch) != 1 || config.Mounts[1].Source != "" {
+    t.Fatalf("Expected one scratch volume without touching the config, got %v", scratch)
+  }
+  containerConfig, hostConfig, err := prepared.convert()
+  if err != nil {t.Fatal(err)}
+  if containerConfig.Labels[SCRATCH_LABEL] != "abc" {t.Errorf("Expected the scratch label, got %v", containerConfig.Labels)}
+  mounts := hostConfig.Mounts
+  if len(mounts) != 3 || mounts[0].Source != "cargo" || mounts[1].Type != "volume" || mounts[1].Source != scratch[0] {
+    t.Errorf("Mounts not converted: %+v", mounts)
+  }
+  if mounts[2].TmpfsOptions == nil || mounts[2].TmpfsOptions.SizeBytes != 64 << 20 {
+    t.Errorf("Tmpfs size not converted: %+v", mounts[2])
+  }
+}
+
+func TestConvertPorts(t *testing.T) {
+  config := &Config{Image: "nginx", Port: 80, Ports: []*PortSpec{
+    {Port: 53, Protocol: UDP, HostPort: 5353, HostIP: "127.0.0.1"},
+  }}
+  containerConfig, hostConfig, err := config.convert()
+  if err != nil {t.Fatal(err)}
+  if len(containerConfig.ExposedPorts) != 2 {t.Errorf("Expected two exposed ports, got %v", containerConfig.ExposedPorts)}
+  if b := hostConfig.PortBindings["80/tcp"]; len(b) != 1 || b[0].HostPort != "" || b[0].HostIP != "0.0.0.0" {
+    t.Errorf("Expected 80/tcp on a free host port, got %+v", b)
+  }
+  if b := hostConfig.PortBindings["53/udp"]; len(b) != 1 || b[0].HostPort != "5353" || b[0].HostIP != "127.0.0.1" {
+    t.Errorf("Expected 53/udp on 127.0.0.1:5353, got %+v", b)
+  }
+  for _, spec := range []*PortSpec{{Port: 0}, {Port: 80, Protocol: "sctp"}, {Port: 80, HostPort: 70000}, {Port: 80, HostIP: "localhost"}} {
+    if err := spec.Validate(); err == nil {t.Errorf("Expected %+v to be invalid", spec)}
+  }
+}
+
+func TestRestartPolicy(t *testing.T) {
+  policy := &RestartPolicy{Name: RestartOnFailure, MaxRetries: 2}
+  if !policy.restarts(1, 1) || policy.restarts(1, 2) || policy.restarts(0, 0) {
+    t.Errorf("Unexpected restarts for %+v", policy)
+  }
+  if !(&RestartPolicy{Name: RestartAlways}).restarts(0, 100) {t.Errorf("Expected always to restart")}
+  if (&RestartPolicy{Name: RestartNever}).restarts(1, 0) {t.Errorf("Expected never not to restart")}
+
+  config := &Config{Image: "nginx", Service: true, Restart: policy}
+  _, hostConfig, err := config.convert()
+  if err != nil {t.Fatal(err)}
+  if hostConfig.RestartPolicy.Name != "on-failure" || hostConfig.RestartPolicy.MaximumRetryCount != 2 {
+    t.Errorf("Restart policy not converted: %+v", hostConfig.RestartPolicy)
+  }
+  config.Service = false
+  if _, _, err := config.convert(); err == nil {t.Errorf("Expected a restart policy to require service mode")}
+  for _, r := range []*RestartPolicy{{Name: "sometimes"}, {Name: RestartAlways, MaxRetries: 1}, {Name: RestartOnFailure, MaxRetries: -1}} {
+    if err := r.Validate(); err == nil {t.Errorf("Expected %+v to be invalid", r)}
+  }
+}
+
+func TestHealthcheck(t *testing.T) {
+  config := &Config{Image: "nginx", Service: true, Healthcheck: &Healthcheck{Command: []string{"curl", "-f", "http://localhost/"}, Interval: 5, Retries: 3}}
+  containerConfig, _, err := config.convert()
+  if err != nil {t.Fatal(err)}
+  health := containerConfig.Healthcheck
+  if health == nil || health.Test[0] != "CMD" || len(health.Test) != 4 || health.Interval.Seconds() != 5 || health.Retries != 3 {
+    t.Errorf("Healthcheck not converted: %+v", health)
+  }
+  config.Service = false
+  if _, _, err := config.convert(); err == nil {t.Errorf("Expected a healthcheck to require service mode")}
+  if err := (&Healthcheck{}).Validate(); err == nil {t.Errorf("Expected a healthcheck without a command to be invalid")}
+  if got := eventHealth("health_status: healthy"); got != HealthHealthy {t.Errorf("Expected healthy, got %q", got)}
+  if got := eventHealth("start"); got != "" {t.Errorf("Expected no health for a start event, got %q", got)}
+}
+
+func TestFollow(t *testing.T) {
+  die := dockerEvent(events.Message{Action: EventDie, Actor: events.Actor{Attributes: map[string]string{"exitCode": "3"}}})
+  if die == nil || die.ExitCode != 3 {t.Fatalf("Expected a die event with code 3, got %+v", die)}
+  if event := dockerEvent(events.Message{Action: "attach"}); event != nil {t.Errorf("Expected attach not to be reported, got %+v", event)}
+
+  // the first die is followed by a restart, the second stops the container
+  in := make(chan *Event, 3)
+  in <- die
+  in <- &Event{Action: EventStart}
+  in <- &Event{Action: EventDie, ExitCode: 1}
+  out := make(chan *Event, 3)
+  dies := 0
+  code, err := follow(nil, in, nil, out, func() (bool, error) {
+    dies++
+    return dies == 2, nil
+  })
+  if err != nil || code != 1 {t.Errorf("Expected code 1, got %d, %v", code, err)}
+  if len(out) != 3 {t.Errorf("Expected all 3 events reported, got %d", len(out))}
+}
@@ -3,6 +3,10 @@
 // containers via JSON.
 package dockercntrl
 
+import (
+  "time"
+)
+
 // Container holds the data required to identify and adjust a
 // docker container.
 type Container struct {
@@ -12,4 +16,40 @@ type Container struct {
   Configuration *Config
   Image         string
   Command       string
+  Labels        map[string]string
+  Status        string     // docker's state, e.g. "running" or "exited"
+}
+
+// Inspection holds the runtime details of a container, as reported
+// by the docker daemon.
+type Inspection struct {
+  Running     bool
+  Restarting  bool
+  ExitCode    int64
+  OOMKilled   bool
+  Health      string          // "" without a healthcheck
+  StartedAt   time.Time
+  FinishedAt  time.Time
+  Ports       []*PortBinding  // published ports, while running
+}
+
+// StartFunc receives the inspection of a container just after it
+// has started.
+type StartFunc func(*Inspection)
+
+// NodeInfo holds the capacity of the machine running the docker daemon.
+type NodeInfo struct {
+  NCPU      int
+  MemTotal  int64
+}
+
+// Image is an image held in the docker host's local cache.
+type Image struct {
+  ID          string
+  Tags        []string
+  Digests     []string
+  Size        int64
+  Created     time.Time
+  LastUsed    time.Time   // zero if no task has used it since the captain started
+  Pulled      bool        // pulled by the captain since it started
 }
@@ -0,0 +1,57 @@
+package dockercntrl
+
+import (
+  "github.com/google/uuid"
+  "fmt"
+)
+
+// Stages of running a task, used to report where a task failed.
+const (
+  StageVerify   = "verify"
+  StagePull     = "pull"
+  StageCreate   = "create"
+  StageNetwork  = "network"
+  StageStart    = "start"
+  StageWait     = "wait"
+)
+
+// TaskError is returned when a task fails, recording the stage it
+// failed at and, once the container has run, its exit code.
+type TaskError struct {
+  Stage     string
+  ExitCode  int64
+  Err       error
+}
+
+func (e *TaskError) Error() string {
+  return fmt.Sprintf("%s failed: %v", e.Stage, e.Err)
+}
+
+func (e *TaskError) Unwrap() error {return e.Err}
+
+// NoContainer is returned by Find when no container was built for
+// the task.
+type NoContainer struct {
+  Id  *uuid.UUID
+}
+
+func (e *NoContainer) Error() string {
+  return fmt.Sprintf("No container for task %s", e.Id)
+}
+
+// Wraps err as having occured at the given stage. Errors that
+// already carry a stage are left untouched.
+func stageError(stage string, err error) error {
+  if err == nil {return nil}
+  if _, ok := err.(*TaskError); ok {return err}
+  return &TaskError{Stage: stage, Err: err}
+}
+
+// Error for a container that ran but did not exit cleanly.
+func exitError(code int64) error {
+  return &TaskError{
+    Stage: StageWait,
+    ExitCode: code,
+    Err: fmt.Errorf("container exited with code %d", code),
+  }
+}
@@ -0,0 +1,586 @@
+package dockercntrl
+
+import (
+  "crypto/sha256"
+  "errors"
+  "fmt"
+  "strings"
+  "sync"
+  "time"
+  "github.com/google/uuid"
+)
+
+// FakeContainer is the in-memory record of a container held by a Fake.
+type FakeContainer struct {
+  Config      *Config
+  Running     bool
+  Exited      bool
+  ExitCode    int64
+  StartedAt   time.Time
+  FinishedAt  time.Time
+  Networks    []string
+  Ports       []*PortBinding
+  Restarts    int
+  scratch     []string
+  image       string      // reference the image was pulled by
+  events      chan *Event // sent by Fake.Exit and Fake.SetHealth
+}
+
+// status mirrors docker's container state names.
+func (c *FakeContainer) status() string {
+  if c.Running {return "running"}
+  if c.Exited {return "exited"}
+  return "created"
+}
+
+// Records the container as started, publishing its ports on the host
+// ports they fix or else on ports counting up from next.
+func (c *FakeContainer) start(next *int) *Inspection {
+  c.Running = true
+  c.StartedAt = time.Now()
+  c.events = make(chan *Event, 16)
+  c.Ports = []*PortBinding{}
+  for _, spec := range c.Config.portSpecs() {
+    binding := &PortBinding{Port: spec.Port, Protocol: spec.protocol(), HostIP: spec.HostIP, HostPort: spec.HostPort}
+    if binding.HostIP == "" {binding.HostIP = "0.0.0.0"}
+    if binding.HostPort == 0 {
+      binding.HostPort = *next
+      *next++
+    }
+    c.Ports = append(c.Ports, binding)
+  }
+  return &Inspection{Running: true, StartedAt: c.StartedAt, Ports: c.Ports}
+}
+
+// Records the container as having run to completion.
+func (c *FakeContainer) finish(code int64) {
+  now := time.Now()
+  if c.StartedAt.IsZero() {c.StartedAt = now}
+  c.FinishedAt = now
+  c.Running = false
+  c.Exited = true
+  c.ExitCode = code
+  c.Ports = nil
+}
+
+// Fake is an in-memory Runtime. It never contacts a docker daemon, which
+// lets the captain's task handling run in tests and CI.
+type Fake struct {
+  // Output of every Run or Stream, and Stderr of every Run, which
+  // exits with ExitCode, or with Hang set runs until stopped like a
+  // service.
+  Output      string
+  Stderr      string
+  ExitCode    int64
+  OOMKilled   bool
+  Hang        bool
+  // Errors returned by the method they are placed under (e.g.
+  // "Create") instead of doing any work, wrapped as State would.
+  Errors      map[string]error
+  Node        NodeInfo  // reported by Info
+  // Used as State uses them. Containers keep their Config secured.
+  Credentials *CredentialStore
+  Policy      *ImagePolicy
+  Hardening   *SecurityPolicy
+  // Events every pull reports, and the time it takes.
+  Progress    []*PullProgress
+  PullTime    time.Duration
+  // Used by every container, and how long Stats takes to report it.
+  Usage       Stats
+  StatsTime   time.Duration
+
+  mu          sync.Mutex
+  next        int
+  containers  map[string]*FakeContainer
+  volumes     map[string]bool
+  images      map[string]*Image
+  pulled      map[string]bool
+  attached    map[string][]string
+  swarm       bool
+  hostPort    int
+}
+
+var _ Runtime = (*Fake)(nil)
+
+// First host port a Fake publishes ports without a fixed one on.
+const FakeHostPort = 32768
+
+// Construct a new, empty Fake runtime
+func NewFake() *Fake {
+  return &Fake{
+    Errors: map[string]error{},
+    Node: NodeInfo{NCPU: 4, MemTotal: 8 << 30},
+    containers: map[string]*FakeContainer{},
+    volumes: map[string]bool{},
+    images: map[string]*Image{},
+    pulled: map[string]bool{},
+    attached: map[string][]string{},
+    hostPort: FakeHostPort,
+  }
+}
+
+// fail returns the error registered for the given method, if any.
+func (f *Fake) fail(method string) error {
+  if f.Errors == nil {return nil}
+  return f.Errors[method]
+}
+
+// Container returns the record of a container created by the Fake.
+func (f *Fake) Container(id string) (*FakeContainer, bool) {
+  f.mu.Lock()
+  defer f.mu.Unlock()
+  c, ok := f.containers[id]
+  return c, ok
+}
+
+// HasVolume reports whether a volume with the given name exists, having
+// been made by VolumeCreate or as a scratch volume.
+func (f *Fake) HasVolume(name string) bool {
+  f.mu.Lock()
+  defer f.mu.Unlock()
+  return f.volumes[name]
+}
+
+// Attached returns the networks a named container was attached to.
+func (f *Fake) Attached(containerName string) []string {
+  f.mu.Lock()
+  defer f.mu.Unlock()
+  return append([]string{}, f.attached[containerName]...)
+}
+
+// FakeDigest returns the digest of the image a Fake holds for a reference.
+func FakeDigest(ref string) string {
+  return fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(ref)))
+}
+
+func fakeImage(ref string, size int64, created time.Time) *Image {
+  return &Image{
+    ID: "sha256:" + ref,
+    Tags: []string{ref},
+    Digests: []string{repository(ref) + "@" + FakeDigest(ref)},
+    Size: size,
+    Created: created,
+  }
+}
+
+// AddImage places an image of the given size in the Fake's cache,
+// as if it had been pulled before the captain started.
+func (f *Fake) AddImage(ref string, size int64, created time.Time) {
+  f.mu.Lock()
+  defer f.mu.Unlock()
+  f.images[ref] = fakeImage(ref, size, created)
+}
+
+// Pulled reports whether the Fake actually pulled the given image,
+// rather than using it from its cache.
+func (f *Fake) Pulled(ref string) bool {
+  f.mu.Lock()
+  defer f.mu.Unlock()
+  return f.pulled[ref]
+}
+
+func (f *Fake) Pull(config *Config) (*string, error) {
+  if !validPullPolicy(config.PullPolicy) {
+    return nil, fmt.Errorf("Invalid pull policy %q", config.PullPolicy)
+  }
+  if err := f.fail("Pull"); err != nil {return nil, err}
+  f.mu.Lock()
+  defer f.mu.Unlock()
+  logs := ""
+  img, cached := f.images[config.Image]
+  switch policy := config.pullPolicy(); {
+  case cached && policy != PullAlways:
+  case policy == PullNever:
+    return nil, notPresent(config.Image)
+  default:
+    if _, err := registryAuth(config, f.Credentials); err != nil {return nil, err}
+    if !cached {
+      img = fakeImage(config.Image, 1 << 20, time.Now())
+      f.images[config.Image] = img
+    }
+    f.pulled[config.Image] = true
+    logs = "Pulled " + config.Image
+    if config.OnPulled != nil {config.OnPulled(f.PullTime)}
+    if config.OnProgress == nil {break}
+    for _, p := range f.Progress {
+      event := *p
+      event.Image = config.Image
+      config.OnProgress(&event)
+    }
+  }
+  img.LastUsed = time.Now()
+  return &logs, nil
+}
+
+func (f *Fake) Create(config *Config) (*Container, error) {
+  if err := checkMounts(config, f.Hardening); err != nil {return nil, stageError(StageVerify, err)}
+  if err := f.Policy.check(config); err != nil {return nil, stageError(StageVerify, err)}
+  secured, err := f.Hardening.secure(config)
+  if err != nil {return nil, stageError(StageVerify, err)}
+  if err := secured.Validate(); err != nil {return nil, stageError(StageVerify, err)}
+  if _, err := f.Pull(config); err != nil {return nil, stageError(StagePull, err)}
+  f.mu.Lock()
+  digests := f.images[config.Image].Digests
+  f.mu.Unlock()
+  if err := verifyDigest(config, digests); err != nil {return nil, stageError(StageVerify, err)}
+  if err := f.fail("Create"); err != nil {return nil, stageError(StageCreate, err)}
+  f.mu.Lock()
+  defer f.mu.Unlock()
+  if config.Name != "" {
+    for _, c := range f.containers {
+      if c.Config.Name == config.Name {
+        return nil, stageError(StageCreate, fmt.Errorf("Conflict. The name %q is already in use", config.Name))
+      }
+    }
+  }
+  f.next++
+  id := fmt.Sprintf("fake%08d", f.next)
+  prepared, scratch := secured.pinned().withScratch(id)
+  if _, _, err := prepared.convert(); err != nil {return nil, stageError(StageCreate, err)}
+  for _, name := range scratch {
+    f.volumes[name] = true
+  }
+  f.containers[id] = &FakeContainer{Config: prepared, scratch: scratch, image: config.Image}
+  return &Container{ID: id, Configuration: config, Image: config.Image}, nil
+}
+
+// Starts a container, passing it to its config's OnStart.
+func (f *Fake) start(c *Container) (*FakeContainer, error) {
+  f.mu.Lock()
+  fc, ok := f.containers[c.ID]
+  if !ok {
+    f.mu.Unlock()
+    return nil, stageError(StageStart, errors.New("No such container: " + c.ID))
+  }
+  inspection := fc.start(&f.hostPort)
+  f.mu.Unlock()
+  if c.Configuration != nil && c.Configuration.OnStart != nil {c.Configuration.OnStart(inspection)}
+  return fc, nil
+}
+
+func (f *Fake) Run(c *Container) (*Result, error) {
+  if err := f.fail("Run"); err != nil {return nil, stageError(StageStart, err)}
+  fc, err := f.start(c)
+  if err != nil {return nil, err}
+  code := f.wait(fc)
+  f.mu.Lock()
+  defer f.mu.Unlock()
+  if !fc.Exited {fc.finish(code)}
+  result := &Result{
+    ExitCode: code,
+    OOMKilled: f.OOMKilled,
+    Stdout: trimLogs(f.Output),
+    Stderr: trimLogs(f.Stderr),
+    StartedAt: fc.StartedAt,
+    FinishedAt: fc.FinishedAt,
+  }
+  if img, ok := f.images[fc.image]; ok {
+    result.Image = img.ID
+    result.Digest = imageDigest(fc.image, img.Digests)
+  }
+  if code != 0 {return result, exitError(code)}
+  return result, nil
+}
+
+// Returns the exit code of a started container once it exits: at once
+// with ExitCode, or when Hang is set once Exit, Stop, Kill or Remove
+// ends it.
+func (f *Fake) wait(fc *FakeContainer) int64 {
+  if !f.Hang {return f.ExitCode}
+  for {
+    if event := <-fc.events; event.Action == EventDie {return event.ExitCode}
+  }
+}
+
+func (f *Fake) Stream(c *Container, out chan<- *Chunk) (int64, error) {
+  defer close(out)
+  if err := f.fail("Stream"); err != nil {return 0, stageError(StageStart, err)}
+  fc, err := f.start(c)
+  if err != nil {return 0, err}
+  if f.Output != "" {
+    w := &chunkWriter{stream: STDOUT, out: out}
+    w.Write([]byte(f.Output))
+    w.Flush()
+  }
+  code := f.wait(fc)
+  f.mu.Lock()
+  if !fc.Exited {fc.finish(code)}
+  f.mu.Unlock()
+  return code, nil
+}
+
+func (f *Fake) List() ([]*Container, error) {
+  if err := f.fail("List"); err != nil {return []*Container{}, err}
+  f.mu.Lock()
+  defer f.mu.Unlock()
+  result := []*Container{}
+  for id, c := range f.containers {
+    var label string
+    if c.Config.Id != nil {label = c.Config.Id.String()}
+    result = append(result, &Container{
+      ID: id,
+      Names: []string{"/" + c.Config.Name},
+      Configuration: c.Config,
+      Image: c.Config.Image,
+      Command: strings.Join(c.Config.Cmd, " "),
+      Labels: map[string]string{LABEL: label},
+      Status: c.status(),
+    })
+  }
+  return result, nil
+}
+
+func (f *Fake) Inspect(c *Container) (*Inspection, error) {
+  if err := f.fail("Inspect"); err != nil {return nil, err}
+  f.mu.Lock()
+  defer f.mu.Unlock()
+  fc, ok := f.containers[c.ID]
+  if !ok {return nil, errors.New("No such container: " + c.ID)}
+  return &Inspection{
+    Running: fc.Running,
+    ExitCode: fc.ExitCode,
+    StartedAt: fc.StartedAt,
+    FinishedAt: fc.FinishedAt,
+    Ports: fc.Ports,
+  }, nil
+}
+
+func (f *Fake) Logs(c *Container) (*Logs, error) {
+  if err := f.fail("Logs"); err != nil {return nil, err}
+  f.mu.Lock()
+  defer f.mu.Unlock()
+  if _, ok := f.containers[c.ID]; !ok {return nil, errors.New("No such container: " + c.ID)}
+  return &Logs{Stdout: trimLogs(f.Output), Stderr: trimLogs(f.Stderr)}, nil
+}
+
+func (f *Fake) Stats(c *Container) (*Stats, error) {
+  if err := f.fail("Stats"); err != nil {return nil, err}
+  time.Sleep(f.StatsTime)
+  f.mu.Lock()
+  defer f.mu.Unlock()
+  if _, ok := f.containers[c.ID]; !ok {return nil, errors.New("No such container: " + c.ID)}
+  stats := f.Usage
+  return &stats, nil
+}
+
+func (f *Fake) Find(id *uuid.UUID) (*Container, error) {
+  if id == nil {return nil, errors.New("No task id given")}
+  if err := f.fail("Find"); err != nil {return nil, err}
+  f.mu.Lock()
+  defer f.mu.Unlock()
+  for cid, c := range f.containers {
+    if c.Config.Id != nil && *c.Config.Id == *id {
+      return &Container{ID: cid, Configuration: c.Config, Image: c.Config.Image}, nil
+    }
+  }
+  return nil, &NoContainer{Id: id}
+}
+
+func (f *Fake) Stop(c *Container) error {
+  if err := f.fail("Stop"); err != nil {return err}
+  return f.stop(c)
+}
+
+func (f *Fake) Kill(c *Container) error {
+  if err := f.fail("Kill"); err != nil {return err}
+  return f.stop(c)
+}
+
+func (f *Fake) stop(c *Container) error {
+  f.mu.Lock()
+  defer f.mu.Unlock()
+  fc, ok := f.containers[c.ID]
+  if !ok {return errors.New("No such container: " + c.ID)}
+  fc.halt()
+  return nil
+}
+
+// Stops the container for good, ending any Monitor of it.
+func (c *FakeContainer) halt() {
+  if c.Exited {return}
+  c.finish(137)
+  select {
+  case c.events <- &Event{Action: EventDie, ExitCode: 137, Time: time.Now()}:
+  default:
+  }
+}
+
+// Exit makes the process of a running container started by Start end
+// with the given exit code. As docker would, the container is then
+// restarted if its restart policy says so, and stopped otherwise.
+func (f *Fake) Exit(id string, code int64) error {
+  f.mu.Lock()
+  defer f.mu.Unlock()
+  fc, ok := f.containers[id]
+  if !ok || !fc.Running {return errors.New("No running container: " + id)}
+  fc.events <- &Event{Action: EventDie, ExitCode: code, Time: time.Now()}
+  if !fc.Config.Restart.restarts(code, fc.Restarts) {
+    fc.finish(code)
+    return nil
+  }
+  fc.Restarts++
+  fc.events <- &Event{Action: EventStart, Time: time.Now()}
+  return nil
+}
+
+// SetHealth makes a running container started by Start report the
+// given health, as its healthcheck would.
+func (f *Fake) SetHealth(id string, health string) error {
+  f.mu.Lock()
+  defer f.mu.Unlock()
+  fc, ok := f.containers[id]
+  if !ok || !fc.Running {return errors.New("No running container: " + id)}
+  fc.events <- &Event{Action: EventHealth, Health: health, Time: time.Now()}
+  return nil
+}
+
+// Start starts a container, which runs until Exit, Stop, Kill or
+// Remove ends it.
+func (f *Fake) Start(c *Container) error {
+  if err := f.fail("Start"); err != nil {return stageError(StageStart, err)}
+  _, err := f.start(c)
+  return err
+}
+
+func (f *Fake) Monitor(c *Container, out chan<- *Event) (int64, error) {
+  defer close(out)
+  if err := f.fail("Monitor"); err != nil {return 0, stageError(StageWait, err)}
+  f.mu.Lock()
+  fc, ok := f.containers[c.ID]
+  f.mu.Unlock()
+  if !ok || fc.events == nil {return 0, stageError(StageWait, errors.New("No started container: " + c.ID))}
+  return follow(fc.Config.Healthcheck, fc.events, nil, out, func() (bool, error) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    return fc.Exited, nil
+  })
+}
+
+func (f *Fake) Remove(c *Container) error {
+  if err := f.fail("Remove"); err != nil {return err}
+  f.mu.Lock()
+  defer f.mu.Unlock()
+  if _, ok := f.containers[c.ID]; !ok {return errors.New("No such container: " + c.ID)}
+  if f.containers[c.ID].Running {f.containers[c.ID].halt()}
+  for _, name := range f.containers[c.ID].scratch {
+    delete(f.volumes, name)
+  }
+  delete(f.containers, c.ID)
+  return nil
+}
+
+func (f *Fake) VolumeCreate(name string) error {
+  if err := f.fail("VolumeCreate"); err != nil {return err}
+  f.mu.Lock()
+  f.volumes[name] = true
+  f.mu.Unlock()
+  return nil
+}
+
+func (f *Fake) Info() (*NodeInfo, error) {
+  if err := f.fail("Info"); err != nil {return nil, err}
+  node := f.Node
+  return &node, nil
+}
+
+func (f *Fake) Images() ([]*Image, error) {
+  if err := f.fail("Images"); err != nil {return nil, err}
+  f.mu.Lock()
+  defer f.mu.Unlock()
+  images := []*Image{}
+  for _, img := range f.images {
+    copied := *img
+    copied.Pulled = f.pulled[img.Tags[0]]
+    images = append(images, &copied)
+  }
+  return images, nil
+}
+
+func (f *Fake) CollectImages(budget int64) ([]string, error) {
+  if err := f.fail("CollectImages"); err != nil {return nil, err}
+  f.mu.Lock()
+  defer f.mu.Unlock()
+  images := []*Image{}
+  for _, img := range f.images {
+    copied := *img
+    copied.Pulled = f.pulled[img.Tags[0]]
+    images = append(images, &copied)
+  }
+  inUse := make(map[string]bool)
+  for _, c := range f.containers {
+    if img, ok := f.images[c.image]; ok {inUse[img.ID] = true}
+  }
+  return evict(images, inUse, budget, func(img *Image) error {
+    delete(f.images, img.Tags[0])
+    delete(f.pulled, img.Tags[0])
+    return nil
+  })
+}
+
+func (f *Fake) GetNetwork() (*Network, error) {
+  if err := f.fail("GetNetwork"); err != nil {return nil, err}
+  return &Network{ID: "armada_bridge"}, nil
+}
+
+func (f *Fake) NetworkConnect(c *Container) error {
+  if c == nil {return errors.New("No container given")}
+  if err := f.fail("NetworkConnect"); err != nil {return err}
+  f.mu.Lock()
+  defer f.mu.Unlock()
+  fc, ok := f.containers[c.ID]
+  if !ok {return errors.New("No such container: " + c.ID)}
+  fc.Networks = append(fc.Networks, "armada_bridge")
+  return nil
+}
+
+func (f *Fake) AttachNetwork(containerName string, network string) error {
+  if err := f.fail("AttachNetwork"); err != nil {return err}
+  f.mu.Lock()
+  f.attached[containerName] = append(f.attached[containerName], network)
+  f.mu.Unlock()
+  return nil
+}
+
+func (f *Fake) DetachNetwork(containerName string, network string) error {
+  if err := f.fail("DetachNetwork"); err != nil {return err}
+  f.mu.Lock()
+  defer f.mu.Unlock()
+  networks := []string{}
+  for _, n := range f.attached[containerName] {
+    if n != network {networks = append(networks, n)}
+  }
+  f.attached[containerName] = networks
+  return nil
+}
+
+// InSwarm reports whether the Fake has joined a swarm and not left it.
+func (f *Fake) InSwarm() bool {
+  f.mu.Lock()
+  defer f.mu.Unlock()
+  return f.swarm
+}
+
+func (f *Fake) JoinSwarm(myIp, token, managerIp string) (int, error) {
+  if err := f.fail("JoinSwarm"); err != nil {return 0, err}
+  f.mu.Lock()
+  f.swarm = true
+  f.mu.Unlock()
+  return 200, nil
+}
+
+func (f *Fake) LeaveSwarm() error {
+  if err := f.fail("LeaveSwarm"); err != nil {return err}
+  f.mu.Lock()
+  f.swarm = false
+  f.mu.Unlock()
+  return nil
+}
+
+func (f *Fake) JoinSwarmAndOverlay(token string, ip string, containerName, overlayName string) error {
+  if _, err := f.JoinSwarm("", token, ip); err != nil {return err}
+  return f.AttachNetwork(containerName, overlayName)
+}
+
+func (f *Fake) JoinOverlay(containerName, overlayName string) error {
+  return f.AttachNetwork(containerName, overlayName)
+}
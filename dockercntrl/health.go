@@ -0,0 +1,127 @@
+package dockercntrl
+
+import (
+  "github.com/docker/docker/api/types/container"
+  "strings"
+  "time"
+  "errors"
+  "fmt"
+)
+
+// Health of a container with a healthcheck.
+const (
+  HealthStarting  = "starting"
+  HealthHealthy   = "healthy"
+  HealthUnhealthy = "unhealthy"
+)
+
+// Action of the events reporting a change in a container's health.
+const EventHealth = "health_status"
+
+// Healthcheck is a command docker runs in a container to check it is
+// healthy. Durations are in seconds; zero keeps the image's setting.
+type Healthcheck struct {
+  Command     []string  `json:"command"`       // run directly, e.g. ["curl", "-f", "http://localhost/"]
+  Interval    int       `json:"interval"`      // between checks
+  Timeout     int       `json:"timeout"`       // before a check is considered to have hung
+  Retries     int       `json:"retries"`       // consecutive failures before unhealthy
+  StartPeriod int       `json:"start_period"`  // after starting, during which failures are not reported
+}
+
+// Validate returns an error for a healthcheck docker would reject.
+func (h *Healthcheck) Validate() error {
+  if h == nil {return nil}
+  if len(h.Command) == 0 {return errors.New("healthcheck requires a command")}
+  if h.Interval < 0 || h.Timeout < 0 || h.Retries < 0 || h.StartPeriod < 0 {
+    return fmt.Errorf("Invalid healthcheck %+v, values must not be negative", *h)
+  }
+  return nil
+}
+
+// Converts the healthcheck into a docker-go-sdk health config. The
+// daemon's API has no start period, which Monitor applies instead.
+func (h *Healthcheck) convert() *container.HealthConfig {
+  if h == nil {return nil}
+  return &container.HealthConfig{
+    Test: append([]string{"CMD"}, h.Command...),
+    Interval: time.Duration(h.Interval) * time.Second,
+    Timeout: time.Duration(h.Timeout) * time.Second,
+    Retries: h.Retries,
+  }
+}
+
+// Returns the healthcheck of a container's config, if any.
+func (c *Container) healthcheck() *Healthcheck {
+  if c.Configuration == nil {return nil}
+  return c.Configuration.Healthcheck
+}
+
+// Returns the health reported by a docker health_status event action,
+// such as "health_status: healthy", or "" for any other action.
+func eventHealth(action string) string {
+  if !strings.HasPrefix(action, EventHealth + ":") {return ""}
+  return strings.TrimSpace(strings.TrimPrefix(action, EventHealth + ":"))
+}
+
+// Event for a container whose health is checked having (re)started,
+// which docker does not report itself.
+func healthStarting() *Event {
+  return &Event{Action: EventHealth, Health: HealthStarting, Time: time.Now()}
+}
+
+// startPeriod holds back unhealthy reports while a container is in the
+// start period of its healthcheck. Once the period ends, a held report
+// is released unless the container has since become healthy.
+type startPeriod struct {
+  length  time.Duration
+  timer   *time.Timer
+  active  bool
+  held    *Event
+}
+
+func newStartPeriod(h *Healthcheck) *startPeriod {
+  p := &startPeriod{}
+  if h != nil {p.length = time.Duration(h.StartPeriod) * time.Second}
+  return p
+}
+
+// Begins the period, as the container has just (re)started.
+func (p *startPeriod) begin() {
+  if p.length == 0 {return}
+  if p.timer != nil {p.timer.Stop()}
+  p.timer = time.NewTimer(p.length)
+  p.active = true
+  p.held = nil
+}
+
+// Returns the event to report, or nil if it is held back.
+func (p *startPeriod) filter(event *Event) *Event {
+  if !p.active {return event}
+  switch event.Health {
+  case HealthUnhealthy:
+    p.held = event
+    return nil
+  case HealthHealthy:
+    p.held = nil
+  }
+  return event
+}
+
+// Fires when the period ends. Never fires when no period is active.
+func (p *startPeriod) ended() <-chan time.Time {
+  if !p.active {return nil}
+  return p.timer.C
+}
+
+// Ends the period, returning the held report if any.
+func (p *startPeriod) end() *Event {
+  p.active = false
+  held := p.held
+  p.held = nil
+  return held
+}
+
+// Stops the period's timer.
+func (p *startPeriod) stop() {
+  if p.timer != nil {p.timer.Stop()}
+}
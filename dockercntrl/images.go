@@ -0,0 +1,127 @@
+package dockercntrl
+
+import (
+  "github.com/docker/docker/api/types"
+  "github.com/docker/docker/client"
+  "fmt"
+  "log"
+  "sort"
+  "strings"
+  "time"
+)
+
+// Pull policies, deciding when State.Pull fetches a Config's image.
+const (
+  PullAlways        = "Always"        // pull on every task
+  PullIfNotPresent  = "IfNotPresent"  // pull only if the image is not cached
+  PullNever         = "Never"         // only ever use the cached image
+)
+
+// Returns the config's pull policy. Without one, images tagged latest
+// (or untagged) are always pulled and any other tag is pulled only if
+// not already cached.
+func (c *Config) pullPolicy() string {
+  if c.PullPolicy != "" {return c.PullPolicy}
+  ref := c.Image
+  if i := strings.LastIndex(ref, "/"); i >= 0 {ref = ref[i+1:]}
+  if strings.Contains(ref, "@") {return PullIfNotPresent}
+  if i := strings.LastIndex(ref, ":"); i < 0 || ref[i+1:] == "latest" {
+    return PullAlways
+  }
+  return PullIfNotPresent
+}
+
+func validPullPolicy(policy string) bool {
+  switch policy {
+  case "", PullAlways, PullIfNotPresent, PullNever:
+    return true
+  }
+  return false
+}
+
+// Returns the ID of a cached image, or "" if it is not cached.
+func (s *State) imageID(ref string) (string, error) {
+  img, _, err := s.Client.ImageInspectWithRaw(s.Context, ref)
+  if client.IsErrImageNotFound(err) {return "", nil}
+  if err != nil {return "", err}
+  return img.ID, nil
+}
+
+// Checks that a config's pulled image has the digest it pins.
+func (s *State) verify(config *Config) error {
+  if config.Digest == "" {return nil}
+  img, _, err := s.Client.ImageInspectWithRaw(s.Context, config.Image)
+  if err != nil {return err}
+  return verifyDigest(config, img.RepoDigests)
+}
+
+// Records that the image with the given ID was just used.
+func (s *State) touch(id string) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  s.lastUsed[id] = time.Now()
+}
+
+// CollectImages removes the least recently used images that the
+// captain pulled and no container uses until the images it pulled fit
+// within budget bytes. Images the captain did not pull, such as the
+// volunteer's own, are never removed. Returns the IDs of the removed
+// images, along with the errors of any that could not be removed.
+func (s *State) CollectImages(budget int64) ([]string, error) {
+  images, err := s.Images()
+  if err != nil {return nil, err}
+  containers, err := s.Client.ContainerList(s.Context, types.ContainerListOptions{All: true})
+  if err != nil {return nil, err}
+  inUse := make(map[string]bool)
+  for _, c := range containers {
+    inUse[c.ImageID] = true
+  }
+  return evict(images, inUse, budget, func(img *Image) error {
+    _, err := s.Client.ImageRemove(s.Context, img.ID, types.ImageRemoveOptions{PruneChildren: true})
+    if err != nil {return err}
+    s.mu.Lock()
+    delete(s.lastUsed, img.ID)
+    delete(s.pulled, img.ID)
+    s.mu.Unlock()
+    return nil
+  })
+}
+
+// Removes images the captain pulled with remove, least recently used
+// first, until they fit within budget. Images in use or not pulled by
+// the captain are never removed. An image that cannot be removed, such
+// as one tagged in several repositories, is logged and skipped for the
+// next. Returns the IDs of the removed images and the errors together.
+func evict(images []*Image, inUse map[string]bool, budget int64, remove func(*Image) error) ([]string, error) {
+  var total int64
+  candidates := []*Image{}
+  for _, img := range images {
+    if !img.Pulled {continue}
+    total += img.Size
+    if !inUse[img.ID] {candidates = append(candidates, img)}
+  }
+  sort.Slice(candidates, func(i, j int) bool {
+    return candidates[i].LastUsed.Before(candidates[j].LastUsed)
+  })
+  removed := []string{}
+  failures := []string{}
+  for _, img := range candidates {
+    if total <= budget {break}
+    if err := remove(img); err != nil {
+      log.Println(err)
+      failures = append(failures, img.ID + ": " + err.Error())
+      continue
+    }
+    removed = append(removed, img.ID)
+    total -= img.Size
+  }
+  if len(failures) > 0 {
+    return removed, fmt.Errorf("Could not remove images %s", strings.Join(failures, "; "))
+  }
+  return removed, nil
+}
+
+// Error for an image that is not cached and may not be pulled.
+func notPresent(ref string) error {
+  return fmt.Errorf("Image %s is not present and pull policy is %s", ref, PullNever)
+}
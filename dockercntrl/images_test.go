@@ -0,0 +1,26 @@
+package dockercntrl
+
+import (
+  "errors"
+  "testing"
+  "time"
+)
+
+func TestEvictSkipsImagesItCannotRemove(t *testing.T) {
+  now := time.Now()
+  images := []*Image{
+    {ID: "tagged-twice", Size: 10, LastUsed: now.Add(-3 * time.Hour), Pulled: true},
+    {ID: "old", Size: 10, LastUsed: now.Add(-2 * time.Hour), Pulled: true},
+    {ID: "used", Size: 10, LastUsed: now.Add(-4 * time.Hour), Pulled: true},
+    {ID: "own", Size: 10, LastUsed: now.Add(-5 * time.Hour)},
+    {ID: "recent", Size: 10, LastUsed: now, Pulled: true},
+  }
+  removed, err := evict(images, map[string]bool{"used": true}, 20, func(img *Image) error {
+    if img.ID == "tagged-twice" {return errors.New("image is referenced in multiple repositories")}
+    return nil
+  })
+  if err == nil {t.Errorf("Expected the failed removal to be returned")}
+  if len(removed) != 2 || removed[0] != "old" || removed[1] != "recent" {
+    t.Errorf("Expected the next images to be removed in its place, got %v", removed)
+  }
+}
@@ -0,0 +1,196 @@
+package dockercntrl
+
+import (
+  "github.com/docker/docker/api/types/filters"
+  "github.com/docker/docker/api/types/mount"
+  "github.com/docker/docker/api/types/volume"
+  "path/filepath"
+  "strings"
+  "errors"
+  "fmt"
+)
+
+// Path of the docker daemon's socket on the host.
+const DockerSocket = "/var/run/docker.sock"
+
+// Label holding the id shared by a container and its scratch volumes.
+const SCRATCH_LABEL = "nebula-scratch"
+
+// Volumes tasks may mount: those named with TASK_VOLUME_PREFIX, and
+// the cargo volume for tasks using storage. Any other volume on the
+// host, such as the volunteer's own, is out of reach.
+const (
+  TASK_VOLUME_PREFIX = "nebula-"
+  CARGO_VOLUME       = "cargo"
+)
+
+// Mount types.
+const (
+  MountVolume   = "volume"   // a named volume, created if missing, see TASK_VOLUME_PREFIX
+  MountTmpfs    = "tmpfs"    // an in-memory filesystem
+  MountBind     = "bind"     // a host path, see SecurityPolicy.AllowBinds
+  MountScratch  = "scratch"  // a volume created for the container and removed with it
+)
+
+// Mount is a filesystem mounted into a container.
+type Mount struct {
+  Type      string  `json:"type"`
+  Source    string  `json:"source,omitempty"`     // volume name or host path
+  Target    string  `json:"target"`
+  ReadOnly  bool    `json:"read_only,omitempty"`
+  Size      int64   `json:"size,omitempty"`       // tmpfs size in bytes
+}
+
+// Validate returns an error for a mount docker would reject.
+func (m *Mount) Validate() error {
+  if m == nil {return errors.New("Empty mount")}
+  if !filepath.IsAbs(m.Target) {return fmt.Errorf("Invalid mount target %q, must be absolute", m.Target)}
+  switch m.Type {
+  case MountVolume:
+    if m.Source == "" {return fmt.Errorf("Volume mount at %s requires a source", m.Target)}
+  case MountBind:
+    if !filepath.IsAbs(m.Source) {return fmt.Errorf("Invalid bind source %q, must be absolute", m.Source)}
+  case MountTmpfs, MountScratch:
+    if m.Source != "" {return fmt.Errorf("%s mount at %s takes no source", m.Type, m.Target)}
+  default:
+    return fmt.Errorf("Invalid mount type %q", m.Type)
+  }
+  if m.Size < 0 || (m.Size > 0 && m.Type != MountTmpfs) {
+    return fmt.Errorf("Invalid size %d for %s mount", m.Size, m.Type)
+  }
+  return nil
+}
+
+// Converts the mount into a docker-go-sdk mount. Scratch mounts must
+// have been given the name of their volume as source.
+func (m *Mount) convert() mount.Mount {
+  converted := mount.Mount{
+    Type: mount.Type(m.Type),
+    Source: m.Source,
+    Target: m.Target,
+    ReadOnly: m.ReadOnly,
+  }
+  switch m.Type {
+  case MountScratch:
+    converted.Type = mount.TypeVolume
+  case MountTmpfs:
+    if m.Size > 0 {converted.TmpfsOptions = &mount.TmpfsOptions{SizeBytes: m.Size}}
+  }
+  return converted
+}
+
+// AddMount mounts the named volume at /data.
+func (c *Config) AddMount(name string) {
+  c.Mounts = append(c.Mounts, &Mount{Type: MountVolume, Source: name, Target: "/data"})
+}
+
+// AddDeamonMount bind-mounts the docker socket, which only system
+// containers may do.
+func (c *Config) AddDeamonMount() {
+  c.Mounts = append(c.Mounts, &Mount{Type: MountBind, Source: DockerSocket, Target: DockerSocket})
+}
+
+// SetSystem marks a config as a container the captain runs itself,
+// such as the spinner or cargo, rather than a task sent by a spinner.
+// Configs decoded from JSON are never system containers.
+func (c *Config) SetSystem() {c.system = true}
+
+// IsSystem reports whether a config was marked with SetSystem.
+func (c *Config) IsSystem() bool {return c.system}
+
+// Checks the mounts and privileges of a config. System containers may
+// do anything; tasks may not run privileged, add capabilities or run
+// unconfined unless the policy allows it, reach the docker socket,
+// bind host paths the policy does not allow or mount volumes outside
+// their namespace. Without a policy tasks get none of these.
+func checkMounts(config *Config, policy *SecurityPolicy) error {
+  for _, m := range config.Mounts {
+    if err := m.Validate(); err != nil {return err}
+  }
+  if config.system {return nil}
+  if config.Privileged {return fmt.Errorf("Tasks may not run privileged")}
+  if security := config.Security; security != nil {
+    for _, cap := range security.CapAdd {
+      if !policy.allowsCapability(cap) {
+        return fmt.Errorf("Capability %s is not allowed by the captain's security policy", cap)
+      }
+    }
+    if !policy.allowsUnconfined() && (security.Seccomp == Unconfined || security.AppArmor == Unconfined) {
+      return fmt.Errorf("Tasks may not run unconfined")
+    }
+  }
+  for _, m := range config.Mounts {
+    switch m.Type {
+    case MountVolume:
+      if !mountable(config, m.Source) {return fmt.Errorf("Tasks may not mount volume %s", m.Source)}
+    case MountBind:
+      if exposesSocket(m.Source) {return fmt.Errorf("Tasks may not mount the docker socket")}
+      if !policy.bindable(m.Source) {return fmt.Errorf("Tasks may not mount host path %s", m.Source)}
+    }
+  }
+  return nil
+}
+
+// Reports whether a task may mount the named volume. Scratch volumes
+// belong to the container they were made for.
+func mountable(config *Config, name string) bool {
+  if name == CARGO_VOLUME {return config.Storage}
+  return strings.HasPrefix(name, TASK_VOLUME_PREFIX) && !strings.HasPrefix(name, SCRATCH_LABEL + "-")
+}
+
+// Reports whether bind-mounting a host path exposes the docker socket.
+func exposesSocket(source string) bool {
+  source = filepath.Clean(source)
+  return source == DockerSocket || source == "/" || strings.HasPrefix(DockerSocket, source + "/")
+}
+
+// Returns the config with each scratch mount given a volume named
+// after id, along with the names of those volumes. The config itself
+// is left untouched.
+func (c *Config) withScratch(id string) (*Config, []string) {
+  names := []string{}
+  mounts := make([]*Mount, len(c.Mounts))
+  for i, m := range c.Mounts {
+    mounts[i] = m
+    if m.Type != MountScratch {continue}
+    scratch := *m
+    scratch.Source = fmt.Sprintf("%s-%s-%d", SCRATCH_LABEL, id, len(names))
+    names = append(names, scratch.Source)
+    mounts[i] = &scratch
+  }
+  if len(names) == 0 {return c, names}
+  prepared := *c
+  prepared.Mounts = mounts
+  prepared.scratch = id
+  return &prepared, names
+}
+
+// Creates the named scratch volumes of a container, labelled with the
+// id they share.
+func (s *State) createScratch(id string, names []string) error {
+  for _, name := range names {
+    _, err := s.Client.VolumeCreate(s.Context, volume.VolumesCreateBody{
+      Driver: "local",
+      Labels: map[string]string{SCRATCH_LABEL: id},
+      Name: name,
+    })
+    if err != nil {
+      s.removeScratch(id)
+      return err
+    }
+  }
+  return nil
+}
+
+// Removes the scratch volumes with the given id, if any.
+func (s *State) removeScratch(id string) error {
+  if id == "" {return nil}
+  scratchFilter := filters.NewArgs()
+  scratchFilter.Add("label", SCRATCH_LABEL+"="+id)
+  resp, err := s.Client.VolumeList(s.Context, scratchFilter)
+  if err != nil {return err}
+  for _, v := range resp.Volumes {
+    if err := s.Client.VolumeRemove(s.Context, v.Name, true); err != nil {return err}
+  }
+  return nil
+}
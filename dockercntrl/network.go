@@ -66,6 +66,11 @@ func (s *State) AttachContainerNetwork(container *Container, network *Network) e
   return err
 }
 
+// Disconnects a named container from a network
+func (s *State) DetachNetwork(container_name string, network string) error {
+  return s.Client.NetworkDisconnect(s.Context, network, container_name, true)
+}
+
 /************************************************
   Docker engine api - direct unix http request
 ************************************************/
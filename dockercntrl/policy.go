@@ -0,0 +1,100 @@
+package dockercntrl
+
+import (
+  "encoding/json"
+  "fmt"
+  "io/ioutil"
+  "path"
+  "strings"
+)
+
+// ImagePolicy restricts which images a captain will run. Allow lists
+// repository patterns, such as "docker.io/library/*", matched against
+// the full repository name of an image without its tag. A pattern
+// ending in "/**" matches every repository below it. An empty Allow
+// list allows every repository.
+type ImagePolicy struct {
+  Allow         []string  `json:"allow"`
+  RequireDigest bool      `json:"require_digest"`  // every task must pin a digest
+}
+
+// LoadPolicy reads an image policy from a JSON file.
+func LoadPolicy(filename string) (*ImagePolicy, error) {
+  body, err := ioutil.ReadFile(filename)
+  if err != nil {return nil, err}
+  var policy ImagePolicy
+  if err := json.Unmarshal(body, &policy); err != nil {return nil, err}
+  for _, pattern := range policy.Allow {
+    if _, err := path.Match(strings.TrimSuffix(pattern, "/**"), ""); err != nil {
+      return nil, fmt.Errorf("Invalid pattern %q in %s", pattern, filename)
+    }
+  }
+  return &policy, nil
+}
+
+// Allows reports whether the policy lets an image be run.
+func (p *ImagePolicy) Allows(ref string) bool {
+  if p == nil || len(p.Allow) == 0 {return true}
+  repo := repository(ref)
+  for _, pattern := range p.Allow {
+    if strings.HasSuffix(pattern, "/**") {
+      if strings.HasPrefix(repo, strings.TrimSuffix(pattern, "**")) {return true}
+      continue
+    }
+    if ok, _ := path.Match(pattern, repo); ok {return true}
+  }
+  return false
+}
+
+// Checks a config against the policy before its image is pulled.
+// System containers run images chosen by the captain, not the
+// spinner, so the policy does not apply to them.
+func (p *ImagePolicy) check(config *Config) error {
+  if config.system {return nil}
+  if !p.Allows(config.Image) {
+    return fmt.Errorf("Image %s is not allowed by the captain's image policy", config.Image)
+  }
+  if p != nil && p.RequireDigest && config.Digest == "" {
+    return fmt.Errorf("Image %s must be pinned to a digest", config.Image)
+  }
+  return nil
+}
+
+// Checks that a pulled image has the digest its config pins, given
+// the image's repo digests ("repository@sha256:...").
+func verifyDigest(config *Config, repoDigests []string) error {
+  if config.Digest == "" {return nil}
+  repo := repository(config.Image)
+  for _, repoDigest := range repoDigests {
+    parts := strings.SplitN(repoDigest, "@", 2)
+    if len(parts) == 2 && repository(parts[0]) == repo && parts[1] == config.Digest {
+      return nil
+    }
+  }
+  return fmt.Errorf("Image %s does not match the required digest %s", config.Image, config.Digest)
+}
+
+// Returns the config with its image referred to by the digest it pins,
+// so the container runs the image verified even if the tag has since
+// moved. The config itself is left untouched.
+func (c *Config) pinned() *Config {
+  if c.Digest == "" {return c}
+  pinned := *c
+  pinned.Image = repository(c.Image) + "@" + c.Digest
+  return &pinned
+}
+
+// Returns the full repository name of an image reference, without its
+// tag or digest, e.g. "alpine:3.11" is "docker.io/library/alpine".
+func repository(ref string) string {
+  if i := strings.Index(ref, "@"); i >= 0 {ref = ref[:i]}
+  if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {ref = ref[:i]}
+  registry := imageRegistry(ref)
+  if parts := strings.SplitN(ref, "/", 2); len(parts) == 2 && registryHost(parts[0]) == registry {
+    ref = parts[1]
+  }
+  if registry == DefaultRegistry && !strings.Contains(ref, "/") {
+    ref = "library/" + ref
+  }
+  return registry + "/" + ref
+}
@@ -0,0 +1,60 @@
+package dockercntrl
+
+import (
+  "testing"
+)
+
+func TestRepository(t *testing.T) {
+  for ref, repo := range map[string]string{
+    "alpine": "docker.io/library/alpine",
+    "alpine:3.11": "docker.io/library/alpine",
+    "team/app@sha256:abc": "docker.io/team/app",
+    "docker.io/alpine": "docker.io/library/alpine",
+    "localhost:5000/app:1.0": "localhost:5000/app",
+    "registry.example.com/team/app": "registry.example.com/team/app",
+  } {
+    if got := repository(ref); got != repo {t.Errorf("repository(%q) = %q, want %q", ref, got, repo)}
+  }
+}
+
+func TestImagePolicy(t *testing.T) {
+  policy := &ImagePolicy{Allow: []string{"docker.io/library/*", "registry.example.com/team/**"}}
+  for ref, allowed := range map[string]bool{
+    "alpine:3.11": true,
+    "docker.io/someone/app": false,
+    "registry.example.com/team/app": true,
+    "registry.example.com/team/group/app": true,
+    "registry.example.com/other/app": false,
+  } {
+    if policy.Allows(ref) != allowed {t.Errorf("Allows(%q) = %v, want %v", ref, !allowed, allowed)}
+  }
+  var none *ImagePolicy
+  if !none.Allows("anything") {t.Errorf("A nil policy should allow every image")}
+
+  policy.RequireDigest = true
+  system := &Config{Image: "docker.io/geoffreyhl/armada-cargo"}
+  if err := policy.check(system); err == nil {t.Errorf("Expected the image to be refused for a task")}
+  system.SetSystem()
+  if err := policy.check(system); err != nil {t.Errorf("Expected a system container to be exempt: %v", err)}
+}
+
+func TestVerifyDigest(t *testing.T) {
+  digests := []string{"docker.io/library/alpine@sha256:good"}
+  if err := verifyDigest(&Config{Image: "alpine:3.11", Digest: "sha256:good"}, digests); err != nil {
+    t.Errorf("Expected a matching digest to verify: %v", err)
+  }
+  if err := verifyDigest(&Config{Image: "alpine:3.11", Digest: "sha256:bad"}, digests); err == nil {
+    t.Errorf("Expected a mismatched digest to be refused")
+  }
+  config := &Config{Image: "alpine:3.11", Digest: "sha256:good"}
+  if pinned := config.pinned(); pinned.Image != "docker.io/library/alpine@sha256:good" || config.Image != "alpine:3.11" {
+    t.Errorf("Unexpected pinned image %q", pinned.Image)
+  }
+}
+
+func TestImageDigest(t *testing.T) {
+  digests := []string{"mirror.example.com/library/alpine@sha256:aaa", "alpine@sha256:bbb"}
+  if got := imageDigest("alpine:3.11", digests); got != "sha256:bbb" {t.Errorf("Expected the matching digest, got %q", got)}
+  if got := imageDigest("team/app", digests); got != "sha256:aaa" {t.Errorf("Expected the first digest, got %q", got)}
+  if got := imageDigest("alpine", nil); got != "" {t.Errorf("Expected no digest, got %q", got)}
+}
@@ -0,0 +1,98 @@
+package dockercntrl
+
+import (
+  "github.com/docker/go-connections/nat"
+  "net"
+  "sort"
+  "strconv"
+  "fmt"
+)
+
+// Protocols a port may be published with.
+const (
+  TCP = "tcp"
+  UDP = "udp"
+)
+
+// PortSpec publishes a container port on the host.
+type PortSpec struct {
+  Port      int     `json:"port"`
+  Protocol  string  `json:"protocol,omitempty"`   // tcp or udp, tcp if empty
+  HostPort  int     `json:"host_port,omitempty"`  // 0 for a free port picked by docker
+  HostIP    string  `json:"host_ip,omitempty"`    // 0.0.0.0 if empty
+}
+
+// PortBinding is a container port as published on the host.
+type PortBinding struct {
+  Port      int     `json:"port"`
+  Protocol  string  `json:"protocol"`
+  HostIP    string  `json:"host_ip"`
+  HostPort  int     `json:"host_port"`
+}
+
+// Validate returns an error for a port spec docker would reject.
+func (p *PortSpec) Validate() error {
+  if p == nil {return fmt.Errorf("Empty port spec")}
+  if p.Port < 1 || p.Port > 65535 {return fmt.Errorf("Invalid port %d", p.Port)}
+  if p.HostPort < 0 || p.HostPort > 65535 {return fmt.Errorf("Invalid host port %d", p.HostPort)}
+  if p.Protocol != "" && p.Protocol != TCP && p.Protocol != UDP {
+    return fmt.Errorf("Invalid protocol %q for port %d", p.Protocol, p.Port)
+  }
+  if p.HostIP != "" && net.ParseIP(p.HostIP) == nil {return fmt.Errorf("Invalid host ip %q", p.HostIP)}
+  return nil
+}
+
+func (p *PortSpec) protocol() string {
+  if p.Protocol == "" {return TCP}
+  return p.Protocol
+}
+
+// Returns the ports a config publishes: its Ports, and its Port as a
+// tcp port on a free host port.
+func (c *Config) portSpecs() []*PortSpec {
+  specs := c.Ports
+  if c.Port != 0 {specs = append([]*PortSpec{{Port: c.Port}}, specs...)}
+  return specs
+}
+
+// Converts the config's ports into the exposed ports and bindings of
+// the docker-go-sdk configs.
+func (c *Config) ports() (nat.PortSet, nat.PortMap, error) {
+  specs := c.portSpecs()
+  if len(specs) == 0 {return nil, nil, nil}
+  exposed := nat.PortSet{}
+  bindings := nat.PortMap{}
+  for _, spec := range specs {
+    if err := spec.Validate(); err != nil {return nil, nil, err}
+    port, err := nat.NewPort(spec.protocol(), strconv.Itoa(spec.Port))
+    if err != nil {return nil, nil, err}
+    binding := nat.PortBinding{HostIP: spec.HostIP, HostPort: ""}
+    if binding.HostIP == "" {binding.HostIP = "0.0.0.0"}
+    if spec.HostPort != 0 {binding.HostPort = strconv.Itoa(spec.HostPort)}
+    exposed[port] = struct{}{}
+    bindings[port] = append(bindings[port], binding)
+  }
+  return exposed, bindings, nil
+}
+
+// Reads the bindings docker made for a running container's ports.
+func portBindings(ports nat.PortMap) []*PortBinding {
+  result := []*PortBinding{}
+  for port, bindings := range ports {
+    for _, b := range bindings {
+      hostPort, err := strconv.Atoi(b.HostPort)
+      if err != nil {continue}
+      result = append(result, &PortBinding{
+        Port: port.Int(),
+        Protocol: port.Proto(),
+        HostIP: b.HostIP,
+        HostPort: hostPort,
+      })
+    }
+  }
+  sort.Slice(result, func(i, j int) bool {
+    if result[i].Port != result[j].Port {return result[i].Port < result[j].Port}
+    return result[i].Protocol < result[j].Protocol
+  })
+  return result
+}
@@ -0,0 +1,62 @@
+package dockercntrl
+
+import (
+  "encoding/json"
+  "errors"
+  "io"
+  "strings"
+  "time"
+)
+
+// PullProgress is a progress event decoded from an image pull. Layer
+// is the layer the event is about, or the tag for events about the
+// whole image. Current and Total are bytes, set while downloading or
+// extracting a layer.
+type PullProgress struct {
+  Image     string  `json:"image"`
+  Layer     string  `json:"layer,omitempty"`
+  Status    string  `json:"status"`
+  Current   int64   `json:"current,omitempty"`
+  Total     int64   `json:"total,omitempty"`
+}
+
+// ProgressFunc receives the progress of a pull as it is decoded.
+type ProgressFunc func(*PullProgress)
+
+// PulledFunc receives how long an image took to pull from its registry.
+type PulledFunc func(time.Duration)
+
+// One message of the JSON stream the daemon sends while pulling.
+type pullMessage struct {
+  ID              string  `json:"id"`
+  Status          string  `json:"status"`
+  ProgressDetail  struct {
+    Current int64 `json:"current"`
+    Total   int64 `json:"total"`
+  } `json:"progressDetail"`
+  Error           string  `json:"error"`
+}
+
+// Decodes the pull stream of an image, passing every event to report
+// if it is not nil. Returns the raw stream as logs, and an error if the
+// daemon reported the pull as failed.
+func readPull(image string, r io.Reader, report ProgressFunc) (string, error) {
+  var logs strings.Builder
+  decoder := json.NewDecoder(io.TeeReader(r, &logs))
+  for {
+    var msg pullMessage
+    err := decoder.Decode(&msg)
+    if err == io.EOF {break}
+    if err != nil {return logs.String(), err}
+    if msg.Error != "" {return logs.String(), errors.New(msg.Error)}
+    if report == nil {continue}
+    report(&PullProgress{
+      Image: image,
+      Layer: msg.ID,
+      Status: msg.Status,
+      Current: msg.ProgressDetail.Current,
+      Total: msg.ProgressDetail.Total,
+    })
+  }
+  return logs.String(), nil
+}
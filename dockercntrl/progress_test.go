@@ -0,0 +1,30 @@
+package dockercntrl
+
+import (
+  "strings"
+  "testing"
+)
+
+func TestReadPull(t *testing.T) {
+  stream := `{"status":"Pulling from library/alpine","id":"3.11"}
+{"status":"Downloading","progressDetail":{"current":1024,"total":2048},"id":"c9b1b535fdd9"}
+{"status":"Pull complete","progressDetail":{},"id":"c9b1b535fdd9"}
+`
+  events := []*PullProgress{}
+  logs, err := readPull("alpine:3.11", strings.NewReader(stream), func(p *PullProgress) {
+    events = append(events, p)
+  })
+  if err != nil {t.Fatal(err)}
+  if logs != stream {t.Errorf("Expected the raw stream as logs, got %q", logs)}
+  if len(events) != 3 {t.Fatalf("Expected 3 events, got %d", len(events))}
+  if e := events[1]; e.Image != "alpine:3.11" || e.Layer != "c9b1b535fdd9" || e.Current != 1024 || e.Total != 2048 {
+    t.Errorf("Progress not decoded: %+v", e)
+  }
+
+  failed := `{"status":"Pulling from library/alpine","id":"3.11"}
+{"errorDetail":{"message":"manifest unknown"},"error":"manifest unknown"}
+`
+  if _, err := readPull("alpine:3.11", strings.NewReader(failed), nil); err == nil || err.Error() != "manifest unknown" {
+    t.Errorf("Expected the stream's error, got %v", err)
+  }
+}
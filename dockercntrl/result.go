@@ -0,0 +1,89 @@
+package dockercntrl
+
+import (
+  "github.com/docker/docker/api/types"
+  "github.com/docker/docker/pkg/stdcopy"
+  "bytes"
+  "io"
+  "strings"
+  "time"
+)
+
+// Result is the outcome of a container run to completion by Run.
+type Result struct {
+  ExitCode    int64      `json:"exit_code"`
+  OOMKilled   bool       `json:"oom_killed"`
+  Stdout      string     `json:"stdout"`
+  Stderr      string     `json:"stderr"`               // empty for containers with a tty
+  StartedAt   time.Time  `json:"started_at"`
+  FinishedAt  time.Time  `json:"finished_at"`
+  Image       string     `json:"image"`                // ID of the image run
+  Digest      string     `json:"digest,omitempty"`     // digest of the image in its repository
+}
+
+// Collects the result of a container that has exited with code.
+func (s *State) result(c *Container, code int64) (*Result, error) {
+  info, err := s.Client.ContainerInspect(s.Context, c.ID)
+  if err != nil {return nil, err}
+  result := &Result{ExitCode: code, Image: info.Image}
+  if info.State != nil {
+    result.OOMKilled = info.State.OOMKilled
+    result.StartedAt, _ = time.Parse(time.RFC3339Nano, info.State.StartedAt)
+    result.FinishedAt, _ = time.Parse(time.RFC3339Nano, info.State.FinishedAt)
+  }
+  logs, err := s.logs(c, info.Config != nil && info.Config.Tty)
+  if err != nil {return nil, err}
+  result.Stdout, result.Stderr = logs.Stdout, logs.Stderr
+  if img, _, err := s.Client.ImageInspectWithRaw(s.Context, info.Image); err == nil && info.Config != nil {
+    result.Digest = imageDigest(info.Config.Image, img.RepoDigests)
+  }
+  return result, nil
+}
+
+// Logs is the output a container has written so far.
+type Logs struct {
+  Stdout  string  `json:"stdout"`
+  Stderr  string  `json:"stderr"`   // empty for containers with a tty
+}
+
+// Logs returns the output of a container, running or not.
+func (s *State) Logs(c *Container) (*Logs, error) {
+  info, err := s.Client.ContainerInspect(s.Context, c.ID)
+  if err != nil {return nil, err}
+  return s.logs(c, info.Config != nil && info.Config.Tty)
+}
+
+// Reads the logs of a container, which docker multiplexes into one
+// stream unless the container has a tty.
+func (s *State) logs(c *Container, tty bool) (*Logs, error) {
+  logs, err := s.Client.ContainerLogs(s.Context, c.ID, types.ContainerLogsOptions{ShowStdout: true, ShowStderr: true})
+  if err != nil {return nil, err}
+  defer logs.Close()
+  var stdout, stderr bytes.Buffer
+  if tty {
+    _, err = io.Copy(&stdout, logs)
+  } else {
+    _, err = stdcopy.StdCopy(&stdout, &stderr, logs)
+  }
+  if err != nil {return nil, err}
+  return &Logs{Stdout: trimLogs(stdout.String()), Stderr: trimLogs(stderr.String())}, nil
+}
+
+// Trims the final line break from a container's logs.
+func trimLogs(logs string) string {
+  return strings.TrimSuffix(strings.TrimSuffix(logs, "\n"), "\r")
+}
+
+// Returns the digest of an image in the repository of ref, given the
+// image's repo digests, or the first digest when none match.
+func imageDigest(ref string, repoDigests []string) string {
+  repo := repository(ref)
+  digest := ""
+  for _, repoDigest := range repoDigests {
+    parts := strings.SplitN(repoDigest, "@", 2)
+    if len(parts) != 2 {continue}
+    if repository(parts[0]) == repo {return parts[1]}
+    if digest == "" {digest = parts[1]}
+  }
+  return digest
+}
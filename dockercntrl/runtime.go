@@ -0,0 +1,41 @@
+package dockercntrl
+
+import (
+  "github.com/google/uuid"
+)
+
+// Runtime is the set of container engine operations a captain relies on.
+// State implements it against the docker daemon; Fake implements it in
+// memory so task handling can be exercised without a daemon.
+type Runtime interface {
+  Pull(config *Config) (*string, error)
+  Create(config *Config) (*Container, error)
+  Run(c *Container) (*Result, error)
+  Stream(c *Container, out chan<- *Chunk) (int64, error)
+  Start(c *Container) error
+  Monitor(c *Container, out chan<- *Event) (int64, error)
+  List() ([]*Container, error)
+  Find(id *uuid.UUID) (*Container, error)
+  Inspect(c *Container) (*Inspection, error)
+  Logs(c *Container) (*Logs, error)
+  Stats(c *Container) (*Stats, error)
+  Stop(c *Container) error
+  Kill(c *Container) error
+  Remove(c *Container) error
+  VolumeCreate(name string) error
+  Info() (*NodeInfo, error)
+  Images() ([]*Image, error)
+  CollectImages(budget int64) ([]string, error)
+
+  GetNetwork() (*Network, error)
+  NetworkConnect(c *Container) error
+  AttachNetwork(containerName string, network string) error
+  DetachNetwork(containerName string, network string) error
+
+  JoinSwarm(myIp, token, managerIp string) (int, error)
+  LeaveSwarm() error
+  JoinSwarmAndOverlay(token string, ip string, containerName, overlayName string) error
+  JoinOverlay(containerName, overlayName string) error
+}
+
+var _ Runtime = (*State)(nil)
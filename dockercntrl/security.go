@@ -0,0 +1,185 @@
+package dockercntrl
+
+import (
+  "github.com/docker/docker/api/types/container"
+  "encoding/json"
+  "io/ioutil"
+  "path"
+  "path/filepath"
+  "regexp"
+  "strings"
+  "fmt"
+)
+
+// Name of the seccomp and AppArmor profile that disables confinement.
+const Unconfined = "unconfined"
+
+// Security holds the privileges of a container. Zero values keep
+// docker's defaults: the image's user, default capabilities, a
+// writable root filesystem and the default seccomp and AppArmor
+// profiles.
+type Security struct {
+  User            string            `json:"user"`               // user[:group], by name or id
+  CapAdd          []string          `json:"cap_add"`
+  CapDrop         []string          `json:"cap_drop"`           // "ALL" drops every capability
+  ReadOnly        bool              `json:"read_only"`          // read-only root filesystem
+  NoNewPrivileges bool              `json:"no_new_privileges"`
+  Seccomp         string            `json:"seccomp"`            // profile name, or "unconfined"
+  AppArmor        string            `json:"apparmor"`           // profile name, or "unconfined"
+  Tmpfs           map[string]string `json:"tmpfs"`              // mount path to options, e.g. "size=64m"
+  seccompProfile  string            // JSON of the seccomp profile, resolved by a SecurityPolicy
+}
+
+var capabilityFormat = regexp.MustCompile(`^(CAP_)?[A-Z_]+$`)
+
+// Validate returns an error for security options docker would reject.
+func (s *Security) Validate() error {
+  if s == nil {return nil}
+  for _, cap := range append(append([]string{}, s.CapAdd...), s.CapDrop...) {
+    if !capabilityFormat.MatchString(cap) {return fmt.Errorf("Invalid capability %q", cap)}
+  }
+  for target := range s.Tmpfs {
+    if !path.IsAbs(target) {return fmt.Errorf("Invalid tmpfs path %q, must be absolute", target)}
+  }
+  if s.Seccomp != "" && s.Seccomp != Unconfined && s.seccompProfile == "" {
+    return fmt.Errorf("Unknown seccomp profile %q", s.Seccomp)
+  }
+  return nil
+}
+
+// Applies the security options to the docker-go-sdk configs.
+func (s *Security) apply(config *container.Config, hostConfig *container.HostConfig) {
+  if s == nil {return}
+  config.User = s.User
+  hostConfig.CapAdd = s.CapAdd
+  hostConfig.CapDrop = s.CapDrop
+  hostConfig.ReadonlyRootfs = s.ReadOnly
+  hostConfig.Tmpfs = s.Tmpfs
+  if s.NoNewPrivileges {
+    hostConfig.SecurityOpt = append(hostConfig.SecurityOpt, "no-new-privileges")
+  }
+  switch s.Seccomp {
+  case "":
+  case Unconfined:
+    hostConfig.SecurityOpt = append(hostConfig.SecurityOpt, "seccomp=" + Unconfined)
+  default:
+    hostConfig.SecurityOpt = append(hostConfig.SecurityOpt, "seccomp=" + s.seccompProfile)
+  }
+  if s.AppArmor != "" {
+    hostConfig.SecurityOpt = append(hostConfig.SecurityOpt, "apparmor=" + s.AppArmor)
+  }
+}
+
+// SecurityPolicy is a hardened baseline the captain forces on every
+// task. A task's own Security may tighten it but not loosen it.
+type SecurityPolicy struct {
+  User            string            `json:"user"`               // user for tasks that set none
+  NonRoot         bool              `json:"non_root"`           // refuse tasks running as root
+  CapDrop         []string          `json:"cap_drop"`           // dropped from every task
+  AllowCaps       []string          `json:"allow_caps"`         // the only capabilities tasks may add
+  ReadOnly        bool              `json:"read_only"`
+  NoNewPrivileges bool              `json:"no_new_privileges"`
+  Seccomp         string            `json:"seccomp"`            // profile for tasks that set none
+  AppArmor        string            `json:"apparmor"`           // profile for tasks that set none
+  AllowUnconfined bool              `json:"allow_unconfined"`   // let tasks disable seccomp or AppArmor
+  SeccompProfiles map[string]string `json:"seccomp_profiles"`   // profile name to JSON profile file
+  AllowBinds      []string          `json:"allow_binds"`        // host directories tasks may bind
+  profiles        map[string]string
+}
+
+// LoadSecurityPolicy reads a security policy from a JSON file, along
+// with the seccomp profiles it names.
+func LoadSecurityPolicy(filename string) (*SecurityPolicy, error) {
+  body, err := ioutil.ReadFile(filename)
+  if err != nil {return nil, err}
+  var policy SecurityPolicy
+  if err := json.Unmarshal(body, &policy); err != nil {return nil, err}
+  policy.profiles = make(map[string]string)
+  for name, file := range policy.SeccompProfiles {
+    profile, err := ioutil.ReadFile(file)
+    if err != nil {return nil, err}
+    if !json.Valid(profile) {return nil, fmt.Errorf("Seccomp profile %s is not valid JSON", file)}
+    policy.profiles[name] = string(profile)
+  }
+  if policy.Seccomp != "" && policy.Seccomp != Unconfined && policy.profiles[policy.Seccomp] == "" {
+    return nil, fmt.Errorf("Unknown seccomp profile %q in %s", policy.Seccomp, filename)
+  }
+  return &policy, nil
+}
+
+// AddSeccompProfile makes a seccomp profile, given as JSON, available
+// to tasks by name.
+func (p *SecurityPolicy) AddSeccompProfile(name, profile string) {
+  if p.profiles == nil {p.profiles = make(map[string]string)}
+  p.profiles[name] = profile
+}
+
+// Returns the config with the policy applied to its security options,
+// or an error if the config asks for more than the policy allows. The
+// config itself is left untouched. System containers are left as
+// configured.
+func (p *SecurityPolicy) secure(config *Config) (*Config, error) {
+  if p == nil || config.system {return config, nil}
+  security := Security{}
+  if config.Security != nil {security = *config.Security}
+  if security.User == "" {security.User = p.User}
+  if p.NonRoot && isRoot(security.User) {
+    return nil, fmt.Errorf("Tasks may not run as root, set a user")
+  }
+  for _, cap := range security.CapAdd {
+    if !p.allowsCapability(cap) {
+      return nil, fmt.Errorf("Capability %s is not allowed by the captain's security policy", cap)
+    }
+  }
+  security.CapDrop = append(append([]string{}, p.CapDrop...), security.CapDrop...)
+  security.ReadOnly = security.ReadOnly || p.ReadOnly
+  security.NoNewPrivileges = security.NoNewPrivileges || p.NoNewPrivileges
+  if security.Seccomp == "" {security.Seccomp = p.Seccomp}
+  if security.AppArmor == "" {security.AppArmor = p.AppArmor}
+  if !p.allowsUnconfined() && (security.Seccomp == Unconfined || security.AppArmor == Unconfined) {
+    return nil, fmt.Errorf("Tasks may not run unconfined")
+  }
+  if security.Seccomp != Unconfined {security.seccompProfile = p.profiles[security.Seccomp]}
+  secured := *config
+  secured.Security = &security
+  return &secured, nil
+}
+
+// Reports whether tasks may add a capability, being one of the
+// policy's AllowCaps. Without a policy they may add none.
+func (p *SecurityPolicy) allowsCapability(cap string) bool {
+  return p != nil && containsCapability(p.AllowCaps, cap)
+}
+
+// Reports whether tasks may disable seccomp or AppArmor.
+func (p *SecurityPolicy) allowsUnconfined() bool {
+  return p != nil && p.AllowUnconfined
+}
+
+// Reports whether tasks may bind a host path, being one of the
+// policy's AllowBinds or below it.
+func (p *SecurityPolicy) bindable(source string) bool {
+  if p == nil {return false}
+  source = filepath.Clean(source)
+  for _, dir := range p.AllowBinds {
+    dir = filepath.Clean(dir)
+    if source == dir || strings.HasPrefix(source, strings.TrimSuffix(dir, "/") + "/") {return true}
+  }
+  return false
+}
+
+// Reports whether a user[:group] runs as root, as does an unset user
+// on almost every image.
+func isRoot(user string) bool {
+  user = strings.SplitN(user, ":", 2)[0]
+  return user == "" || user == "root" || user == "0"
+}
+
+func containsCapability(caps []string, cap string) bool {
+  cap = strings.TrimPrefix(strings.ToUpper(cap), "CAP_")
+  for _, c := range caps {
+    c = strings.TrimPrefix(strings.ToUpper(c), "CAP_")
+    if c == "ALL" || c == cap {return true}
+  }
+  return false
+}
@@ -0,0 +1,68 @@
+package dockercntrl
+
+import (
+  "testing"
+  "github.com/google/uuid"
+)
+
+func TestSecurityPolicy(t *testing.T) {
+  id := uuid.New()
+  policy := &SecurityPolicy{
+    User: "nobody",
+    NonRoot: true,
+    CapDrop: []string{"ALL"},
+    AllowCaps: []string{"NET_BIND_SERVICE"},
+    ReadOnly: true,
+    NoNewPrivileges: true,
+  }
+  config := &Config{Id: &id, Image: "alpine", Security: &Security{CapAdd: []string{"CAP_NET_BIND_SERVICE"}, Tmpfs: map[string]string{"/tmp": "size=64m"}}}
+  secured, err := policy.secure(config)
+  if err != nil {t.Fatal(err)}
+  if config.Security.User != "" {t.Errorf("secure modified the task's config")}
+  containerConfig, hostConfig, err := secured.convert()
+  if err != nil {t.Fatal(err)}
+  if containerConfig.User != "nobody" || !hostConfig.ReadonlyRootfs || len(hostConfig.CapDrop) != 1 || hostConfig.Tmpfs["/tmp"] != "size=64m" {
+    t.Errorf("Baseline not applied: user %q, %+v", containerConfig.User, hostConfig)
+  }
+  if len(hostConfig.SecurityOpt) != 1 || hostConfig.SecurityOpt[0] != "no-new-privileges" {
+    t.Errorf("Unexpected security options %v", hostConfig.SecurityOpt)
+  }
+
+  refused := []*Security{
+    {User: "root"},
+    {User: "0:0"},
+    {User: "app", CapAdd: []string{"SYS_ADMIN"}},
+    {User: "app", Seccomp: Unconfined},
+  }
+  for _, security := range refused {
+    if _, err := policy.secure(&Config{Id: &id, Image: "alpine", Security: security}); err == nil {
+      t.Errorf("Expected %+v to be refused", security)
+    }
+  }
+  system := &Config{Image: "alpine", Security: &Security{User: "root"}}
+  system.SetSystem()
+  if secured, err := policy.secure(system); err != nil || secured != system {
+    t.Errorf("Expected system containers to be left as configured")
+  }
+}
+
+func TestSecurityValidate(t *testing.T) {
+  invalid := []*Security{
+    {CapAdd: []string{"net admin"}},
+    {Tmpfs: map[string]string{"tmp": ""}},
+    {Seccomp: "custom"},
+  }
+  for _, s := range invalid {
+    if err := s.Validate(); err == nil {t.Errorf("Expected %+v to be invalid", s)}
+  }
+  policy := &SecurityPolicy{}
+  policy.AddSeccompProfile("custom", `{"defaultAction": "SCMP_ACT_ERRNO"}`)
+  id := uuid.New()
+  secured, err := policy.secure(&Config{Id: &id, Image: "alpine", Security: &Security{Seccomp: "custom"}})
+  if err != nil {t.Fatal(err)}
+  _, hostConfig, err := secured.convert()
+  if err != nil {t.Fatal(err)}
+  if len(hostConfig.SecurityOpt) != 1 || hostConfig.SecurityOpt[0] != `seccomp={"defaultAction": "SCMP_ACT_ERRNO"}` {
+    t.Errorf("Seccomp profile not applied: %v", hostConfig.SecurityOpt)
+  }
+}
@@ -0,0 +1,182 @@
+package dockercntrl
+
+import (
+  "github.com/docker/docker/api/types"
+  "github.com/docker/docker/api/types/container"
+  "github.com/docker/docker/api/types/events"
+  "github.com/docker/docker/api/types/filters"
+  "golang.org/x/net/context"
+  "strconv"
+  "time"
+  "fmt"
+)
+
+// Restart policies of a service, see RestartPolicy.
+const (
+  RestartNever      = "never"
+  RestartOnFailure  = "on-failure"
+  RestartAlways     = "always"
+)
+
+// RestartPolicy decides whether docker restarts a service's container
+// when it exits. A container stopped by the captain is never restarted.
+type RestartPolicy struct {
+  Name        string  `json:"name"`
+  MaxRetries  int     `json:"max_retries,omitempty"`  // on-failure only, 0 for unlimited
+}
+
+// Validate returns an error for a restart policy docker would reject.
+func (r *RestartPolicy) Validate() error {
+  if r == nil {return nil}
+  switch r.Name {
+  case RestartNever, RestartAlways:
+    if r.MaxRetries != 0 {return fmt.Errorf("max_retries only applies to the %s restart policy", RestartOnFailure)}
+  case RestartOnFailure:
+    if r.MaxRetries < 0 {return fmt.Errorf("Invalid max_retries %d", r.MaxRetries)}
+  default:
+    return fmt.Errorf("Invalid restart policy %q", r.Name)
+  }
+  return nil
+}
+
+// Converts the restart policy into a docker-go-sdk restart policy.
+func (r *RestartPolicy) convert() container.RestartPolicy {
+  if r == nil || r.Name == RestartNever {return container.RestartPolicy{Name: "no"}}
+  return container.RestartPolicy{Name: r.Name, MaximumRetryCount: r.MaxRetries}
+}
+
+// Reports whether the policy restarts a container exiting with code
+// after it has been restarted the given number of times.
+func (r *RestartPolicy) restarts(code int64, restarts int) bool {
+  if r == nil {return false}
+  switch r.Name {
+  case RestartAlways:
+    return true
+  case RestartOnFailure:
+    return code != 0 && (r.MaxRetries == 0 || restarts < r.MaxRetries)
+  }
+  return false
+}
+
+// Actions of the container events a Monitor reports.
+const (
+  EventStart  = "start"  // the container was restarted
+  EventDie    = "die"    // the container's process exited
+  EventOOM    = "oom"    // the container ran out of memory
+)
+
+// Event is something that happened to a container while monitored.
+type Event struct {
+  Action    string     `json:"action"`
+  ExitCode  int64      `json:"exit_code,omitempty"`  // set when the container dies
+  Health    string     `json:"health,omitempty"`     // set when its health changes
+  Time      time.Time  `json:"time"`
+}
+
+// Start starts a built docker container without waiting for it,
+// passing it to its config's OnStart. Failures are returned as a
+// *TaskError.
+func (s *State) Start(c *Container) error {
+  if err := s.Client.ContainerStart(s.Context, c.ID, types.ContainerStartOptions{}); err != nil {
+    return stageError(StageStart, err)
+  }
+  return s.started(c)
+}
+
+// Monitor follows a started container through docker events, sending
+// each start, die, oom and health_status event to out, until it stops
+// and will not be restarted. Unhealthy reports are held back during
+// the start period of the container's healthcheck. Returns its last
+// exit code; failures are returned as a *TaskError. out is closed once
+// Monitor returns.
+func (s *State) Monitor(c *Container, out chan<- *Event) (int64, error) {
+  defer close(out)
+  ctx, cancel := context.WithCancel(s.Context)
+  defer cancel()
+  containerFilter := filters.NewArgs()
+  containerFilter.Add("type", "container")
+  containerFilter.Add("container", c.ID)
+  messages, errs := s.Client.Events(ctx, types.EventsOptions{Filters: containerFilter})
+  // the container may have stopped before events were followed
+  if code, done, err := s.stopped(c); err != nil || done {return code, stageError(StageWait, err)}
+  events := make(chan *Event)
+  go func() {
+    for {
+      select {
+      case msg := <-messages:
+        event := dockerEvent(msg)
+        if event == nil {break}
+        select {
+        case events <- event:
+        case <-ctx.Done():
+          return
+        }
+      case <-ctx.Done():
+        return
+      }
+    }
+  }()
+  return follow(c.healthcheck(), events, errs, out, func() (bool, error) {
+    _, done, err := s.stopped(c)
+    return done, err
+  })
+}
+
+// Converts a docker event into the Event a Monitor reports, or nil for
+// events it does not report.
+func dockerEvent(msg events.Message) *Event {
+  at := time.Unix(0, msg.TimeNano)
+  if health := eventHealth(msg.Action); health != "" {
+    return &Event{Action: EventHealth, Health: health, Time: at}
+  }
+  switch msg.Action {
+  case EventStart, EventOOM:
+    return &Event{Action: msg.Action, Time: at}
+  case EventDie:
+    code, _ := strconv.ParseInt(msg.Actor.Attributes["exitCode"], 10, 64)
+    return &Event{Action: msg.Action, ExitCode: code, Time: at}
+  }
+  return nil
+}
+
+// follow is the loop behind Monitor, for State and Fake alike. It
+// passes the events of a started container to out until a die leaves
+// the container stopped for good, as stopped reports, and returns its
+// exit code. Unhealthy reports are held back during the start period
+// of the healthcheck, which begins again whenever the container does.
+func follow(h *Healthcheck, events <-chan *Event, errs <-chan error, out chan<- *Event, stopped func() (bool, error)) (int64, error) {
+  period := newStartPeriod(h)
+  defer period.stop()
+  period.begin()
+  if h != nil {out <- healthStarting()}
+  for {
+    select {
+    case event := <-events:
+      switch event.Action {
+      case EventHealth:
+        if event = period.filter(event); event != nil {out <- event}
+      case EventStart:
+        period.begin()
+        out <- event
+        if h != nil {out <- healthStarting()}
+      case EventDie:
+        out <- event
+        if done, err := stopped(); err != nil || done {return event.ExitCode, stageError(StageWait, err)}
+      default:
+        out <- event
+      }
+    case <-period.ended():
+      if held := period.end(); held != nil {out <- held}
+    case err := <-errs:
+      return 0, stageError(StageWait, err)
+    }
+  }
+}
+
+// Reports whether a container has stopped for good, neither running
+// nor about to be restarted, along with its exit code.
+func (s *State) stopped(c *Container) (int64, bool, error) {
+  inspection, err := s.Inspect(c)
+  if err != nil {return 0, false, err}
+  return inspection.ExitCode, !inspection.Running && !inspection.Restarting, nil
+}
@@ -6,10 +6,13 @@ import (
   "github.com/docker/docker/api/types"
   "github.com/docker/docker/api/types/filters"
   "github.com/docker/docker/api/types/volume"
-  "bytes"
-  "strings"
   "net/http"
   "net"
+  "errors"
+  "fmt"
+  "github.com/google/uuid"
+  "time"
+  "sync"
 )
 
 // State holds the structs required to manipulate the docker daemon
@@ -18,6 +21,15 @@ type State struct {
   Client  *client.Client
   // TODO: switch to sdk
   HttpUnix  *http.Client
+  // Registry credentials kept on the captain, may be nil
+  Credentials *CredentialStore
+  // Images the captain may run, nil to allow any
+  Policy    *ImagePolicy
+  // Baseline forced on the security options of tasks, may be nil
+  Hardening *SecurityPolicy
+  mu        sync.Mutex
+  lastUsed  map[string]time.Time  // image ID to when a task last used it
+  pulled    map[string]bool       // IDs of the images the captain pulled
 }
 
 // Construct a new State
@@ -32,58 +44,96 @@ func New() (*State, error) {
       },
     },
   }
-  return &State{Context: ctx, Client: cli, HttpUnix: &httpUnix}, err
+  return &State{
+    Context: ctx,
+    Client: cli,
+    HttpUnix: &httpUnix,
+    lastUsed: make(map[string]time.Time),
+    pulled: make(map[string]bool),
+  }, err
 }
 
-// Pull pulls the associated image into cache
+// Pull pulls the associated image into cache, as allowed by the
+// config's pull policy, and records the image as used. Progress is
+// passed to the config's OnProgress as the pull goes, and the time
+// taken to its OnPulled once the image has been pulled.
 func (s *State) Pull(config *Config) (*string, error) {
-  reader, err := s.Client.ImagePull(s.Context, config.Image, types.ImagePullOptions{})
+  if !validPullPolicy(config.PullPolicy) {
+    return nil, fmt.Errorf("Invalid pull policy %q", config.PullPolicy)
+  }
+  logs := ""
+  policy := config.pullPolicy()
+  if policy != PullAlways {
+    id, err := s.imageID(config.Image)
+    if err != nil {return nil, err}
+    if id != "" {
+      s.touch(id)
+      return &logs, nil
+    }
+    if policy == PullNever {return nil, notPresent(config.Image)}
+  }
+  auth, err := registryAuth(config, s.Credentials)
+  if err != nil {return nil, err}
+  began := time.Now()
+  reader, err := s.Client.ImagePull(s.Context, config.Image, types.ImagePullOptions{RegistryAuth: auth})
   if err != nil {
     return nil, err
   }
-  buf := new(bytes.Buffer)
-  buf.ReadFrom(reader)
-  logs := buf.String()
-  return &logs, err
+  defer reader.Close()
+  logs, err = readPull(config.Image, reader, config.OnProgress)
+  if err != nil {return nil, err}
+  if config.OnPulled != nil {config.OnPulled(time.Since(began))}
+  id, err := s.imageID(config.Image)
+  if err != nil {return nil, err}
+  s.touch(id)
+  s.mu.Lock()
+  s.pulled[id] = true
+  s.mu.Unlock()
+  return &logs, nil
 }
 
 // Create builds a docker container
 func (s *State) Create(configuration *Config) (*Container, error) {
-  if _, err := s.Pull(configuration); err != nil {return nil, err}
-  config, hostConfig, err := configuration.convert()
-  if err != nil {return nil, err}
+  if err := checkMounts(configuration, s.Hardening); err != nil {return nil, stageError(StageVerify, err)}
+  if err := s.Policy.check(configuration); err != nil {return nil, stageError(StageVerify, err)}
+  secured, err := s.Hardening.secure(configuration)
+  if err != nil {return nil, stageError(StageVerify, err)}
+  if err := secured.Validate(); err != nil {return nil, stageError(StageVerify, err)}
+  if _, err := s.Pull(configuration); err != nil {return nil, stageError(StagePull, err)}
+  if err := s.verify(configuration); err != nil {return nil, stageError(StageVerify, err)}
+  prepared, scratch := secured.pinned().withScratch(uuid.New().String())
+  config, hostConfig, err := prepared.convert()
+  if err != nil {return nil, stageError(StageCreate, err)}
+  if err := s.createScratch(prepared.scratch, scratch); err != nil {return nil, stageError(StageCreate, err)}
 
   resp, err := s.Client.ContainerCreate(s.Context, config, hostConfig, nil, configuration.Name)
-  if err != nil {return nil, err}
+  if err != nil {
+    s.removeScratch(prepared.scratch)
+    return nil, stageError(StageCreate, err)
+  }
 
-  return &Container{ID: resp.ID, State: s}, nil
+  return &Container{ID: resp.ID, State: s, Configuration: configuration}, nil
 }
 
-// Run runs a built docker container. It follows the execution to display
-// logs at the end of execution.
-func (s *State) Run(c *Container) (*string, error) {
-  if err := s.Client.ContainerStart(s.Context, c.ID, types.ContainerStartOptions{}); err != nil {
-		return nil, err
-	}
-	_, err := s.Client.ContainerWait(s.Context, c.ID)
-	if err != nil {return nil, err}
-
-	out, err := s.Client.ContainerLogs(s.Context, c.ID, types.ContainerLogsOptions{ShowStdout: true})
-	if err != nil {
-		return nil, err
-	}
-  buf := new(bytes.Buffer)
-  buf.ReadFrom(out)
-  logs := strings.TrimSuffix(strings.TrimSuffix(buf.String(), "\n"), "\r")
-  return &logs, nil
+// Run runs a built docker container, waiting for it to exit and
+// collecting its result. Failures are returned as a *TaskError; a
+// container exiting with a non-zero code still returns its result.
+func (s *State) Run(c *Container) (*Result, error) {
+  if err := s.Start(c); err != nil {return nil, err}
+  code, err := s.Client.ContainerWait(s.Context, c.ID)
+  if err != nil {return nil, stageError(StageWait, err)}
+  result, err := s.result(c, code)
+  if err != nil {return nil, stageError(StageWait, err)}
+  if code != 0 {return result, exitError(code)}
+  return result, nil
 }
 
 // List returns all nebula-specific docker containers, determined by
-// docker label
+// docker label. Task containers carry their task id as the label value.
 func (s *State) List() ([]*Container, error) {
   result := []*Container{}
   nebulaFilter := filters.NewArgs()
-  nebulaFilter.Add("label", "nebula-id=captain")
+  nebulaFilter.Add("label", LABEL)
   resp, err := s.Client.ContainerList(s.Context, types.ContainerListOptions{
     All: true,
     Filters: nebulaFilter,
@@ -98,14 +148,71 @@ func (s *State) List() ([]*Container, error) {
       Names: c.Names,
       Image: c.Image,
       Command: c.Command,
+      Labels: c.Labels,
+      Status: c.State,
     })
   }
 
   return result, nil
 }
 
-// Kill immediately ends a docker container
-func (s *State) Kill(cont *Container) error {
+// Inspect returns the runtime details of a container
+func (s *State) Inspect(cont *Container) (*Inspection, error) {
+  resp, err := s.Client.ContainerInspect(s.Context, cont.ID)
+  if err != nil {return nil, err}
+  inspection := &Inspection{}
+  if resp.State != nil {
+    inspection.Running = resp.State.Running
+    inspection.Restarting = resp.State.Restarting
+    if resp.State.Health != nil {inspection.Health = resp.State.Health.Status}
+    inspection.ExitCode = int64(resp.State.ExitCode)
+    inspection.OOMKilled = resp.State.OOMKilled
+    inspection.StartedAt, _ = time.Parse(time.RFC3339Nano, resp.State.StartedAt)
+    inspection.FinishedAt, _ = time.Parse(time.RFC3339Nano, resp.State.FinishedAt)
+  }
+  if resp.NetworkSettings != nil {inspection.Ports = portBindings(resp.NetworkSettings.Ports)}
+  return inspection, nil
+}
+
+// Passes a container that has just started to its config's OnStart,
+// killing it if it cannot be inspected.
+func (s *State) started(c *Container) error {
+  if c.Configuration == nil || c.Configuration.OnStart == nil {return nil}
+  inspection, err := s.Inspect(c)
+  if err != nil {
+    s.Kill(c)
+    return stageError(StageStart, err)
+  }
+  c.Configuration.OnStart(inspection)
+  return nil
+}
+
+// Find returns the container built for the task with the given id,
+// determined by docker label
+func (s *State) Find(id *uuid.UUID) (*Container, error) {
+  if id == nil {return nil, errors.New("No task id given")}
+  taskFilter := filters.NewArgs()
+  taskFilter.Add("label", LABEL+"="+id.String())
+  resp, err := s.Client.ContainerList(s.Context, types.ContainerListOptions{
+    All: true,
+    Filters: taskFilter,
+  })
+  if err != nil {return nil, err}
+  if len(resp) == 0 {return nil, &NoContainer{Id: id}}
+  c := resp[0]
+  return &Container{
+    ID: c.ID,
+    State: s,
+    Names: c.Names,
+    Image: c.Image,
+    Command: c.Command,
+    Labels: c.Labels,
+    Status: c.State,
+  }, nil
+}
+
+// Stop gracefully ends a docker container
+func (s *State) Stop(cont *Container) error {
   // Sends SIGTERM followed by SIGKILL after a graceperio
   // Change last value from nil to give custom graceperiod
   err := s.Client.ContainerStop(s.Context, cont.ID, nil)
@@ -116,14 +223,52 @@ func (s *State) Kill(cont *Container) error {
   return nil
 }
 
+// Kill immediately ends a docker container
+func (s *State) Kill(cont *Container) error {
+  return s.Client.ContainerKill(s.Context, cont.ID, "KILL")
+}
+
 // Remove clears a docker container from the docker deamon
 func (s *State) Remove(cont *Container) error {
-  err := s.Client.ContainerRemove(s.Context, cont.ID, types.ContainerRemoveOptions{
+  info, err := s.Client.ContainerInspect(s.Context, cont.ID)
+  if err != nil {return err}
+  err = s.Client.ContainerRemove(s.Context, cont.ID, types.ContainerRemoveOptions{
     RemoveVolumes: false,
     RemoveLinks: false,
     Force: true,
   })
-  return err
+  if err != nil {return err}
+  return s.removeScratch(info.Config.Labels[SCRATCH_LABEL])
+}
+
+// Images returns the images in the docker host's local cache
+func (s *State) Images() ([]*Image, error) {
+  resp, err := s.Client.ImageList(s.Context, types.ImageListOptions{})
+  if err != nil {return nil, err}
+  images := make([]*Image, len(resp))
+  for i, img := range resp {
+    images[i] = &Image{
+      ID: img.ID,
+      Tags: img.RepoTags,
+      Digests: img.RepoDigests,
+      Size: img.Size,
+      Created: time.Unix(img.Created, 0),
+    }
+  }
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  for _, img := range images {
+    img.LastUsed = s.lastUsed[img.ID]
+    img.Pulled = s.pulled[img.ID]
+  }
+  return images, nil
+}
+
+// Info returns the capacity of the docker host
+func (s *State) Info() (*NodeInfo, error) {
+  info, err := s.Client.Info(s.Context)
+  if err != nil {return nil, err}
+  return &NodeInfo{NCPU: info.NCPU, MemTotal: info.MemTotal}, nil
 }
 
 // Creates a Volume
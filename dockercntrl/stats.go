@@ -0,0 +1,28 @@
+package dockercntrl
+
+import (
+  "github.com/docker/docker/api/types"
+  "encoding/json"
+)
+
+// Stats is a container's resource usage, as sampled by the daemon.
+type Stats struct {
+  CPUSeconds  float64  `json:"cpu_seconds"`   // total CPU time used
+  MemoryUsage int64    `json:"memory_usage"`  // bytes
+  MemoryLimit int64    `json:"memory_limit"`  // bytes
+}
+
+// Stats samples the resource usage of a running container.
+func (s *State) Stats(c *Container) (*Stats, error) {
+  resp, err := s.Client.ContainerStats(s.Context, c.ID, false)
+  if err != nil {return nil, err}
+  defer resp.Body.Close()
+  var stats types.StatsJSON
+  if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {return nil, err}
+  return &Stats{
+    // reported in nanoseconds on linux
+    CPUSeconds: float64(stats.CPUStats.CPUUsage.TotalUsage) / 1e9,
+    MemoryUsage: int64(stats.MemoryStats.Usage),
+    MemoryLimit: int64(stats.MemoryStats.Limit),
+  }, nil
+}
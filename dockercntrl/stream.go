@@ -0,0 +1,118 @@
+package dockercntrl
+
+import (
+  "github.com/docker/docker/api/types"
+  "github.com/docker/docker/pkg/stdcopy"
+  "io"
+  "unicode/utf8"
+)
+
+const (
+  STDOUT = "stdout"
+  STDERR = "stderr"
+  // Largest payload put in a single Chunk, in bytes once encoded as
+  // JSON. Leaves room under the comms socket read limit for the
+  // message the chunk is sent in.
+  MaxChunkSize = 2048
+)
+
+// Chunk is a piece of container output captured while it runs.
+type Chunk struct {
+  Stream  string
+  Data    string
+}
+
+// chunkWriter turns writes into Chunks of at most MaxChunkSize bytes
+// once encoded, split only between runes. A rune cut off at the end of
+// a write is held until the next one completes it, or Flush.
+type chunkWriter struct {
+  stream  string
+  out     chan<- *Chunk
+  partial []byte
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+  data := append(w.partial, p...)
+  w.partial = nil
+  if cut := partialRune(data); cut > 0 {
+    w.partial = append([]byte{}, data[len(data)-cut:]...)
+    data = data[:len(data)-cut]
+  }
+  w.send(data)
+  return len(p), nil
+}
+
+// Flush sends whatever is left of a rune cut off by the last write.
+func (w *chunkWriter) Flush() {
+  w.send(w.partial)
+  w.partial = nil
+}
+
+func (w *chunkWriter) send(data []byte) {
+  start, size := 0, 0
+  for i := 0; i < len(data); {
+    r, n := utf8.DecodeRune(data[i:])
+    if size + encodedLen(r, n) > MaxChunkSize {
+      w.out <- &Chunk{Stream: w.stream, Data: string(data[start:i])}
+      start, size = i, 0
+    }
+    size += encodedLen(r, n)
+    i += n
+  }
+  if start < len(data) {w.out <- &Chunk{Stream: w.stream, Data: string(data[start:])}}
+}
+
+// Returns the length of an incomplete rune at the end of p.
+func partialRune(p []byte) int {
+  for n := 1; n < utf8.UTFMax && n <= len(p); n++ {
+    if !utf8.RuneStart(p[len(p)-n]) {continue}
+    if utf8.FullRune(p[len(p)-n:]) {return 0}
+    return n
+  }
+  return 0
+}
+
+// Returns how long a rune n bytes long is once encoding/json has
+// escaped it. Invalid bytes are written as \ufffd.
+func encodedLen(r rune, n int) int {
+  switch {
+  case r == utf8.RuneError && n == 1:
+    return 6
+  case r == '"' || r == '\\' || r == '\n' || r == '\r' || r == '\t':
+    return 2
+  case r < 0x20 || r == '<' || r == '>' || r == '&' || r == '\u2028' || r == '\u2029':
+    return 6
+  }
+  return n
+}
+
+// Stream runs a built docker container, sending its output to out as it
+// is produced rather than collecting it after exit. Stdout and stderr are
+// separated unless the container has a tty. Returns the exit code once the
+// container stops; out is closed before returning. Failures are returned
+// as a *TaskError.
+func (s *State) Stream(c *Container, out chan<- *Chunk) (int64, error) {
+  defer close(out)
+  if err := s.Start(c); err != nil {return 0, err}
+  logs, err := s.Client.ContainerLogs(s.Context, c.ID, types.ContainerLogsOptions{
+    ShowStdout: true,
+    ShowStderr: true,
+    Follow: true,
+  })
+  if err != nil {return 0, stageError(StageWait, err)}
+  defer logs.Close()
+
+  stdout := &chunkWriter{stream: STDOUT, out: out}
+  stderr := &chunkWriter{stream: STDERR, out: out}
+  if c.Configuration != nil && c.Configuration.Tty {
+    _, err = io.Copy(stdout, logs)
+  } else {
+    _, err = stdcopy.StdCopy(stdout, stderr, logs)
+  }
+  stdout.Flush()
+  stderr.Flush()
+  if err != nil {return 0, stageError(StageWait, err)}
+
+  code, err := s.Client.ContainerWait(s.Context, c.ID)
+  return code, stageError(StageWait, err)
+}
@@ -0,0 +1,45 @@
+package dockercntrl
+
+import (
+  "encoding/json"
+  "strings"
+  "testing"
+  "unicode/utf8"
+)
+
+func TestChunkWriter(t *testing.T) {
+  output := strings.Repeat("<a&b>", 1000) + strings.Repeat("héllo wörld\n", 500) + "\x01\"done\" "
+  out := make(chan *Chunk)
+  go func() {
+    w := &chunkWriter{stream: STDOUT, out: out}
+    w.Write([]byte(output[:5001]))
+    // writes of 7 bytes cut through the two byte runes
+    for start := 5001; start < len(output); start += 7 {
+      end := start + 7
+      if end > len(output) {end = len(output)}
+      w.Write([]byte(output[start:end]))
+    }
+    w.Flush()
+    close(out)
+  }()
+
+  got := ""
+  for chunk := range out {
+    if !utf8.ValidString(chunk.Data) {t.Fatalf("Chunk %q splits a rune", chunk.Data)}
+    encoded, err := json.Marshal(chunk.Data)
+    if err != nil {t.Fatal(err)}
+    // less the quotes around the string
+    if len(encoded) - 2 > MaxChunkSize {t.Errorf("Chunk encodes to %d bytes, over %d", len(encoded) - 2, MaxChunkSize)}
+    got += chunk.Data
+  }
+  if got != output {t.Errorf("Chunks do not add up to the output")}
+}
+
+func TestChunkWriterFlush(t *testing.T) {
+  out := make(chan *Chunk, 2)
+  w := &chunkWriter{stream: STDERR, out: out}
+  w.Write([]byte("ok \xe2\x82"))
+  if chunk := <-out; chunk.Data != "ok " {t.Errorf("Expected the cut rune to be held, got %q", chunk.Data)}
+  w.Flush()
+  if chunk := <-out; chunk.Data != "\xe2\x82" {t.Errorf("Expected Flush to send the cut rune, got %q", chunk.Data)}
+}
@@ -2,6 +2,8 @@ package dockercntrl
 
 import(
   "encoding/json"
+  "errors"
+  "fmt"
   "bytes"
   "io/ioutil"
   "log"
@@ -77,3 +79,18 @@ func (s *State) JoinSwarm(myIp, token, managerIp string) (int, error) {
 	}
   return response.StatusCode, nil
 }
+
+// leave the swarm, forcing it even if this node is a manager
+func (s *State) LeaveSwarm() error {
+  response, err := s.HttpUnix.Post("http://unix/swarm/leave?force=true", "application/json", nil)
+  if err != nil {
+		log.Println(err)
+    return err
+	}
+  response.Body.Close()
+  // 503: node is not part of a swarm
+  if response.StatusCode != 200 && response.StatusCode != 503 {
+    return errors.New(fmt.Sprintf("Leave swarm failed. Response code: %d", response.StatusCode))
+  }
+  return nil
+}
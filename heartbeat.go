@@ -0,0 +1,65 @@
+package captain
+
+import (
+  "github.com/armadanet/spinner/spinresp"
+  "log"
+  "time"
+)
+
+const (
+  // How often the captain reports its status to the spinner.
+  HeartbeatPeriod = 30 * time.Second
+)
+
+// NodeStatus is the Data of a Heartbeat response, describing the
+// captain's machine for the spinner's scheduler. CPUs are counted in
+// cores and memory in bytes, against the captain's contribution.
+type NodeStatus struct {
+  Name          string    `json:"name"`
+  TotalCPUs     float64   `json:"total_cpus"`
+  UsedCPUs      float64   `json:"used_cpus"`
+  FreeCPUs      float64   `json:"free_cpus"`
+  TotalMemory   int64     `json:"total_memory"`
+  UsedMemory    int64     `json:"used_memory"`
+  FreeMemory    int64     `json:"free_memory"`
+  RunningTasks  int       `json:"running_tasks"`
+  Images        int       `json:"images"`
+  ImagesSize    int64     `json:"images_size"`
+  Uptime        float64   `json:"uptime"` // seconds
+}
+
+// Status gathers the current state of the captain's machine. Parts
+// the runtime cannot report are left empty.
+func (c *Captain) Status() *NodeStatus {
+  status := &NodeStatus{
+    Name: c.name,
+    Uptime: time.Since(c.started).Seconds(),
+  }
+  if capacity, used, err := c.admission.load(); err != nil {
+    log.Println(err)
+  } else {
+    status.TotalCPUs = float64(capacity.nanoCPUs) / nanoCPUs
+    status.UsedCPUs = float64(used.nanoCPUs) / nanoCPUs
+    status.FreeCPUs = status.TotalCPUs - status.UsedCPUs
+    status.TotalMemory = capacity.memory
+    status.UsedMemory = used.memory
+    status.FreeMemory = capacity.memory - used.memory
+  }
+  for _, task := range c.tasks.List() {
+    if task.State == TaskRunning {status.RunningTasks++}
+  }
+  if images, err := c.state.Images(); err != nil {
+    log.Println(err)
+  } else {
+    status.Images = len(images)
+    for _, img := range images {
+      status.ImagesSize += img.Size
+    }
+  }
+  return status
+}
+
+// Returns the message sent to the spinner to show the captain is alive.
+func (c *Captain) heartbeat() *spinresp.Response {
+  return &spinresp.Response{Code: Heartbeat, Data: c.Status()}
+}
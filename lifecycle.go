@@ -0,0 +1,142 @@
+package captain
+
+import (
+  "github.com/armadanet/captain/dockercntrl"
+  "log"
+  "time"
+)
+
+const (
+  // How long running tasks are given to finish on shutdown before
+  // they are stopped, and again to report once stopped.
+  ShutdownGrace = 10 * time.Second
+)
+
+// Sends data to the spinner, unless the captain has stopped talking
+// to it, in which case the data is dropped.
+func (c *Captain) send(write chan interface{}, data interface{}) {
+  select {
+  case write <- data:
+  case <- c.stopped:
+    log.Println("Captain stopped, dropping response.")
+  }
+}
+
+// Records a captain-internal container so it is removed on shutdown.
+func (c *Captain) addSystem(container *dockercntrl.Container) {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  c.system = append(c.system, container)
+}
+
+// Removes the system containers started under the given name, such as
+// a spinner that died, so that they can be started again.
+func (c *Captain) removeSystem(name string) {
+  if name == "" {return}
+  c.mu.Lock()
+  kept := []*dockercntrl.Container{}
+  removed := []*dockercntrl.Container{}
+  for _, container := range c.system {
+    if container.Configuration != nil && container.Configuration.Name == name {
+      removed = append(removed, container)
+    } else {
+      kept = append(kept, container)
+    }
+  }
+  c.system = kept
+  c.mu.Unlock()
+  for _, container := range removed {
+    if err := c.state.Remove(container); err != nil {log.Println(err)}
+  }
+}
+
+// Reports whether the captain has begun shutting down.
+func (c *Captain) exiting() bool {
+  select {
+  case <- c.exit:
+    return true
+  default:
+    return false
+  }
+}
+
+// Counts a task as in flight, unless the captain has begun shutting
+// down. Checked under the lock stop closes exit with, so no task is
+// added once drain is waiting.
+func (c *Captain) accept(config *dockercntrl.Config) bool {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  if c.exiting() {return false}
+  if config.Id != nil {c.inflight.Add(1)}
+  return true
+}
+
+// Stops the captain taking new tasks. Safe to call more than once.
+func (c *Captain) stop() {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  if !c.exiting() {close(c.exit)}
+}
+
+// Waits for in-flight tasks to finish, up to the given duration.
+func (c *Captain) drain(timeout time.Duration) bool {
+  done := make(chan interface{})
+  go func() {
+    c.inflight.Wait()
+    close(done)
+  }()
+  select {
+  case <- done:
+    return true
+  case <- time.After(timeout):
+    return false
+  }
+}
+
+// Shuts the captain down: no new tasks are accepted, in-flight tasks
+// are drained or stopped, the system containers are removed, and the
+// captain detaches from its networks and leaves the swarm.
+func (c *Captain) shutdown() {
+  log.Println("Shutting down captain...")
+  c.stop()
+
+  if !c.drain(ShutdownGrace) {
+    log.Println("Stopping running tasks...")
+    for _, task := range c.tasks.List() {
+      if task.ContainerID == "" || (task.State != TaskCreated && task.State != TaskRunning) {continue}
+      if err := c.state.Stop(&dockercntrl.Container{ID: task.ContainerID}); err != nil {
+        log.Println(err)
+      }
+    }
+    if !c.drain(ShutdownGrace) {
+      log.Println("Tasks did not report before shutdown.")
+    }
+  }
+  close(c.stopped)
+
+  c.mu.Lock()
+  system := c.system
+  c.system = nil
+  overlay := c.overlay
+  c.mu.Unlock()
+  for _, container := range system {
+    if err := c.state.Remove(container); err != nil {
+      log.Println(err)
+    }
+  }
+
+  if overlay != "" {
+    if err := c.state.DetachNetwork(c.name, overlay); err != nil {
+      log.Println(err)
+    }
+  }
+  if c.bridge != "" {
+    if err := c.state.DetachNetwork(c.name, c.bridge); err != nil {
+      log.Println(err)
+    }
+  }
+  if err := c.state.LeaveSwarm(); err != nil {
+    log.Println(err)
+  }
+  log.Println("Captain shut down.")
+}
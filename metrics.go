@@ -0,0 +1,241 @@
+package captain
+
+import (
+  "github.com/armadanet/captain/dockercntrl"
+  "github.com/google/uuid"
+  "fmt"
+  "io"
+  "log"
+  "net/http"
+  "sort"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+// Most container stats fetched at once for /metrics. Docker takes
+// about a second to answer each request.
+const MaxStatsRequests = 8
+
+// Upper bounds, in seconds, of the buckets image pulls and task
+// runtimes are counted in.
+var (
+  PullBuckets    = []float64{0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+  RuntimeBuckets = []float64{1, 5, 15, 30, 60, 300, 900, 1800, 3600, 14400}
+)
+
+// metrics counts what happens to the captain's tasks and connection
+// for the /metrics endpoint. It is safe for concurrent use.
+type metrics struct {
+  mu          sync.Mutex
+  received    int64
+  succeeded   int64
+  failed      map[string]int64  // by stage
+  reconnects  int64
+  pulls       *histogram
+  runtimes    *histogram
+}
+
+func newMetrics() *metrics {
+  return &metrics{
+    failed: map[string]int64{},
+    pulls: newHistogram(PullBuckets),
+    runtimes: newHistogram(RuntimeBuckets),
+  }
+}
+
+// histogram counts observations in buckets with fixed upper bounds.
+type histogram struct {
+  bounds  []float64
+  counts  []int64
+  sum     float64
+  count   int64
+}
+
+func newHistogram(bounds []float64) *histogram {
+  return &histogram{bounds: bounds, counts: make([]int64, len(bounds))}
+}
+
+func (h *histogram) observe(v float64) {
+  for i, bound := range h.bounds {
+    if v <= bound {h.counts[i]++}
+  }
+  h.sum += v
+  h.count++
+}
+
+// Counts a task sent to the captain. The captain's own system
+// containers, which have no id, are never counted.
+func (m *metrics) taskReceived(id *uuid.UUID) {
+  if id == nil {return}
+  m.mu.Lock()
+  defer m.mu.Unlock()
+  m.received++
+}
+
+// Counts a task that failed at the given stage.
+func (m *metrics) taskFailed(id *uuid.UUID, stage string) {
+  if id == nil {return}
+  m.mu.Lock()
+  defer m.mu.Unlock()
+  m.failed[stage]++
+}
+
+// Counts a finished task by its record. A task whose container exited
+// with code 0 is a success, and one that exited otherwise without
+// being failed failed waiting on its container. The runtime of every
+// task whose container ran is observed.
+func (m *metrics) taskFinished(task Task) {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+  if task.State == TaskExited && task.ExitCode == 0 {
+    m.succeeded++
+  } else if task.State == TaskExited {
+    m.failed[dockercntrl.StageWait]++
+  }
+  if !task.Started.IsZero() {m.runtimes.observe(task.Finished.Sub(task.Started).Seconds())}
+}
+
+// Observes how long an image took to pull.
+func (m *metrics) pulled(d time.Duration) {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+  m.pulls.observe(d.Seconds())
+}
+
+// Counts a link to the spinner reopened after being lost.
+func (m *metrics) reconnected() {
+  m.mu.Lock()
+  defer m.mu.Unlock()
+  m.reconnects++
+}
+
+// Records the outcome of a task that ExecuteConfig has finished with.
+// Failures are counted as they are reported, by fail, reject and
+// refuse.
+func (c *Captain) observe(config *dockercntrl.Config) {
+  task, ok := c.tasks.Get(config.Id)
+  if !ok || !done(task) {return}
+  c.metrics.taskFinished(task)
+}
+
+// WriteMetrics writes the captain's metrics in the Prometheus text
+// format: counts of tasks, pull and runtime histograms, the spinner
+// connection, and the resource usage of every running task container.
+func (c *Captain) WriteMetrics(w io.Writer) {
+  m := c.metrics
+  m.mu.Lock()
+  counter(w, "captain_tasks_received_total", "Tasks sent to the captain.")
+  sample(w, "captain_tasks_received_total", nil, float64(m.received))
+  counter(w, "captain_tasks_succeeded_total", "Tasks that exited with code 0.")
+  sample(w, "captain_tasks_succeeded_total", nil, float64(m.succeeded))
+  counter(w, "captain_tasks_failed_total", "Tasks that failed, by the stage they failed at.")
+  stages := make([]string, 0, len(m.failed))
+  for stage := range m.failed {stages = append(stages, stage)}
+  sort.Strings(stages)
+  for _, stage := range stages {
+    sample(w, "captain_tasks_failed_total", []string{"stage", stage}, float64(m.failed[stage]))
+  }
+  writeHistogram(w, "captain_image_pull_duration_seconds", "Time taken to pull images from their registries.", m.pulls)
+  writeHistogram(w, "captain_task_runtime_seconds", "Time task containers ran for.", m.runtimes)
+  counter(w, "captain_spinner_reconnects_total", "Links to the spinner reopened after being lost.")
+  sample(w, "captain_spinner_reconnects_total", nil, float64(m.reconnects))
+  m.mu.Unlock()
+
+  connected := 0.0
+  if c.spinnerStatus().Connected {connected = 1}
+  gauge(w, "captain_spinner_connected", "Whether the captain is connected to a spinner.")
+  sample(w, "captain_spinner_connected", nil, connected)
+
+  running := []Task{}
+  for _, task := range c.tasks.List() {
+    if task.State == TaskRunning && task.ContainerID != "" {running = append(running, task)}
+  }
+  sort.Slice(running, func(i, j int) bool {return running[i].ContainerID < running[j].ContainerID})
+  gauge(w, "captain_running_tasks", "Tasks whose containers are running.")
+  sample(w, "captain_running_tasks", nil, float64(len(running)))
+  usage := c.containerStats(running)
+  for _, series := range []struct{
+    name, kind, help  string
+    value             func(*dockercntrl.Stats) float64
+  }{
+    {"captain_container_cpu_seconds_total", "counter", "CPU time used by a task container.",
+      func(s *dockercntrl.Stats) float64 {return s.CPUSeconds}},
+    {"captain_container_memory_usage_bytes", "gauge", "Memory used by a task container.",
+      func(s *dockercntrl.Stats) float64 {return float64(s.MemoryUsage)}},
+    {"captain_container_memory_limit_bytes", "gauge", "Memory a task container may use.",
+      func(s *dockercntrl.Stats) float64 {return float64(s.MemoryLimit)}},
+  } {
+    header(w, series.name, series.kind, series.help)
+    for _, task := range running {
+      stats, ok := usage[task.ContainerID]
+      if !ok {continue}
+      sample(w, series.name, []string{"nebula_id", task.Id.String(), "container_id", task.ContainerID}, series.value(stats))
+    }
+  }
+}
+
+// Fetches the stats of the containers of the given tasks, at most
+// MaxStatsRequests at a time, by container id. Containers whose stats
+// cannot be read are left out.
+func (c *Captain) containerStats(tasks []Task) map[string]*dockercntrl.Stats {
+  usage := map[string]*dockercntrl.Stats{}
+  var mu sync.Mutex
+  var wg sync.WaitGroup
+  slots := make(chan struct{}, MaxStatsRequests)
+  for _, task := range tasks {
+    wg.Add(1)
+    slots <- struct{}{}
+    go func(id string) {
+      defer wg.Done()
+      defer func() {<- slots}()
+      stats, err := c.state.Stats(&dockercntrl.Container{ID: id})
+      if err != nil {
+        log.Println(err)
+        return
+      }
+      mu.Lock()
+      usage[id] = stats
+      mu.Unlock()
+    }(task.ContainerID)
+  }
+  wg.Wait()
+  return usage
+}
+
+// Serves WriteMetrics over http.
+func (c *Captain) serveMetrics(w http.ResponseWriter, r *http.Request) {
+  w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+  c.WriteMetrics(w)
+}
+
+func header(w io.Writer, name, kind, help string) {
+  fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func counter(w io.Writer, name, help string) {header(w, name, "counter", help)}
+
+func gauge(w io.Writer, name, help string) {header(w, name, "gauge", help)}
+
+// Writes one sample, with labels given as name, value pairs.
+func sample(w io.Writer, name string, labels []string, value float64) {
+  pairs := make([]string, 0, len(labels) / 2)
+  for i := 0; i + 1 < len(labels); i += 2 {
+    pairs = append(pairs, labels[i] + `="` + labelEscaper.Replace(labels[i+1]) + `"`)
+  }
+  if len(pairs) > 0 {name += "{" + strings.Join(pairs, ",") + "}"}
+  fmt.Fprintf(w, "%s %s\n", name, strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func writeHistogram(w io.Writer, name, help string, h *histogram) {
+  header(w, name, "histogram", help)
+  for i, bound := range h.bounds {
+    sample(w, name + "_bucket", []string{"le", strconv.FormatFloat(bound, 'g', -1, 64)}, float64(h.counts[i]))
+  }
+  sample(w, name + "_bucket", []string{"le", "+Inf"}, float64(h.count))
+  sample(w, name + "_sum", nil, h.sum)
+  sample(w, name + "_count", nil, float64(h.count))
+}
@@ -0,0 +1,67 @@
+package captain
+
+import (
+  "github.com/armadanet/captain/dockercntrl"
+)
+
+// Response codes sent by the captain in addition to those
+// defined by spinresp.
+const (
+  InsufficientResources = -2  // the captain has no room for a task
+  Failed                = -1  // a task could not be run to completion
+  Output                = 2   // a chunk of output from a streaming task
+  Exit                  = 3   // a streaming task has finished
+  Ack                   = 4   // a command on a task has been handled
+  Heartbeat             = 5   // the captain is alive; sent periodically
+  Pulling               = 6   // progress pulling the image of a task
+  Started               = 7   // a task's container has started
+  ServiceEvent          = 8   // a service died, restarted, ran out of memory or changed health
+)
+
+// OutputChunk is the Data of an Output response. Seq starts at 0
+// and increases by one for every Output or Exit message sent about
+// a task.
+type OutputChunk struct {
+  Seq     int     `json:"seq"`
+  Stream  string  `json:"stream"`
+  Data    string  `json:"data"`
+}
+
+// ExitStatus is the Data of an Exit response, always the last
+// message sent for a streaming task.
+type ExitStatus struct {
+  Seq       int     `json:"seq"`
+  ExitCode  int64   `json:"exit_code"`
+}
+
+// TaskStarted is the Data of a Started response, sent once the
+// container of a service, or of a task publishing ports, is running.
+// Ports lists the host ports they were published on.
+type TaskStarted struct {
+  Ports   []*dockercntrl.PortBinding  `json:"ports"`
+}
+
+// ServiceStatus is the Data of a ServiceEvent response. Restarts
+// counts the times the service has been restarted so far. A service
+// ends with an Exit response once it stops and is not restarted.
+type ServiceStatus struct {
+  Event     *dockercntrl.Event  `json:"event"`
+  Restarts  int                 `json:"restarts"`
+}
+
+// Stage at which a task fails when the captain cannot determine
+// whether it has room for it.
+const StageAdmission = "admission"
+
+// Failure is the Data of a Failed response. Stage is one of the
+// dockercntrl stages (verify, pull, create, network, start, wait),
+// admission, or timeout for a task stopped for running out of time;
+// ExitCode and Output are only set once the container has run, along
+// with its full Result for a task run to completion.
+type Failure struct {
+  Stage     string                `json:"stage"`
+  ExitCode  int64                 `json:"exit_code"`
+  Error     string                `json:"error"`
+  Output    string                `json:"output,omitempty"`
+  Result    *dockercntrl.Result   `json:"result,omitempty"`
+}
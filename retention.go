@@ -0,0 +1,138 @@
+package captain
+
+import (
+  "github.com/armadanet/captain/dockercntrl"
+  "fmt"
+  "log"
+  "sort"
+  "strconv"
+  "strings"
+  "time"
+)
+
+// Policies for how long the containers of finished tasks are kept.
+const (
+  RetainAll     = ""        // never remove them
+  RetainNone    = "none"    // remove them as soon as their task finishes
+  RetainLast    = "last"    // keep the Count most recently finished
+  RetainFor     = "for"     // keep them for Duration after finishing
+  RetainFailed  = "failed"  // keep only those of tasks that failed
+)
+
+const (
+  // How often the reaper applies the retention policy, besides after
+  // every task.
+  ReapPeriod = time.Minute
+)
+
+// Retention decides which containers of finished tasks are removed.
+// The zero value keeps every container.
+type Retention struct {
+  Policy    string
+  Count     int
+  Duration  time.Duration
+}
+
+// ParseRetention reads a retention policy written as "none", "failed",
+// "last:<count>" or "for:<duration>", e.g. "last:100" or "for:24h".
+// An empty string keeps every container.
+func ParseRetention(s string) (Retention, error) {
+  policy, arg := s, ""
+  if i := strings.Index(s, ":"); i >= 0 {policy, arg = s[:i], s[i+1:]}
+  r := Retention{Policy: policy}
+  switch policy {
+  case RetainAll, RetainNone, RetainFailed:
+    if arg != "" {return r, fmt.Errorf("Retention policy %q takes no argument", policy)}
+  case RetainLast:
+    count, err := strconv.Atoi(arg)
+    if err != nil || count < 0 {return r, fmt.Errorf("Invalid retention count %q", arg)}
+    r.Count = count
+  case RetainFor:
+    duration, err := time.ParseDuration(arg)
+    if err != nil || duration < 0 {return r, fmt.Errorf("Invalid retention duration %q", arg)}
+    r.Duration = duration
+  default:
+    return r, fmt.Errorf("Unknown retention policy %q", policy)
+  }
+  return r, nil
+}
+
+// Returns the finished tasks whose containers the policy removes.
+func (r Retention) expired(tasks []Task, now time.Time) []Task {
+  finished := []Task{}
+  for _, task := range tasks {
+    if task.ContainerID == "" || !done(task) {continue}
+    finished = append(finished, task)
+  }
+  switch r.Policy {
+  case RetainNone:
+    return finished
+  case RetainLast:
+    if len(finished) <= r.Count {return nil}
+    sort.Slice(finished, func(i, j int) bool {
+      return finished[i].Finished.After(finished[j].Finished)
+    })
+    return finished[r.Count:]
+  case RetainFor:
+    expired := []Task{}
+    for _, task := range finished {
+      if now.Sub(task.Finished) >= r.Duration {expired = append(expired, task)}
+    }
+    return expired
+  case RetainFailed:
+    expired := []Task{}
+    for _, task := range finished {
+      if task.State == TaskExited && task.ExitCode == 0 {expired = append(expired, task)}
+    }
+    return expired
+  }
+  return nil
+}
+
+// Reports whether a task has finished running.
+func done(task Task) bool {
+  return task.State == TaskExited || task.State == TaskFailed || task.State == TaskTimedOut
+}
+
+// SetRetention sets how long the containers of finished tasks are
+// kept. It should be called before the captain is run.
+func (c *Captain) SetRetention(retention Retention) {
+  c.retention = retention
+}
+
+// Reap removes the containers of finished tasks that the retention
+// policy no longer keeps, forgetting their tasks.
+func (c *Captain) Reap() {
+  for _, task := range c.retention.expired(c.tasks.List(), time.Now()) {
+    if err := c.state.Remove(&dockercntrl.Container{ID: task.ContainerID}); err != nil {
+      log.Println(err)
+      continue
+    }
+    c.tasks.Delete(&task.Id)
+  }
+}
+
+// Asks the reaper to apply the retention policy, as a task finished.
+func (c *Captain) reapSoon() {
+  select {
+  case c.reap <- struct{}{}:
+  default:
+  }
+}
+
+// Applies the retention policy every ReapPeriod and whenever a task
+// finishes, until the captain shuts down.
+func (c *Captain) reaper() {
+  if c.retention.Policy == RetainAll {return}
+  ticker := time.NewTicker(ReapPeriod)
+  defer ticker.Stop()
+  for {
+    select {
+    case <- ticker.C:
+    case <- c.reap:
+    case <- c.exit:
+      return
+    }
+    c.Reap()
+  }
+}
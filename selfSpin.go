@@ -9,6 +9,7 @@ import (
   "os"
   "encoding/json"
   "context"
+  "errors"
   "time"
   //"github.com/google/uuid"
 )
@@ -17,18 +18,27 @@ type chanMessage struct {
   Spinner_Overlay string `json:"OverlayName"`
 }
 
-func (c *Captain) SelfSpin() (string, string) {
+// SelfSpin starts a spinner on this machine and waits for it to report
+// its overlay, returning the overlay and the spinner's name. A spinner
+// spun before is removed first so the new one can take its name. Gives
+// up if the captain shuts down first.
+func (c *Captain) SelfSpin() (string, string, error) {
   // get spinner name from env var
   spinner_name := os.Getenv("SPINNER_NAME")
+  c.removeSystem(spinner_name)
   // start channel listener
   ch := make(chan chanMessage)
-  go spinnerNotifyChannel(ch)
+  done := make(chan interface{})
+  defer close(done)
+  go spinnerNotifyChannel(ch, done)
   // create and run spinner container
   go c.StartSpinner(spinner_name)
 
   select {
   case mes := <-ch:
-    return mes.Spinner_Overlay, spinner_name
+    return mes.Spinner_Overlay, spinner_name, nil
+  case <- c.exit:
+    return "", "", errors.New("Captain shut down before the spinner started")
   }
 }
 
@@ -54,17 +64,19 @@ func (c *Captain) StartSpinner(spinner_name string) {
   }
   // -v /var/run/docker.sock:/var/run/docker.sock
   spinnerconfig.AddDeamonMount()
+  spinnerconfig.SetSystem()
   go c.ExecuteConfig(spinnerconfig, nil)
 }
 
-func spinnerNotifyChannel(c chan chanMessage) {
+// Serves the spinner's notice that it has started, passing it to c,
+// until done is closed.
+func spinnerNotifyChannel(c chan chanMessage, done chan interface{}) {
   router := mux.NewRouter().StrictSlash(true)
   s := &http.Server{
   	Addr:           ":9999",
   	Handler:        router,
   }
-  qs := make(chan int)
-  go quitServer(qs, s)
+  go quitServer(done, s)
   router.HandleFunc("/joinFinished", func(w http.ResponseWriter, r *http.Request) {
     var res chanMessage
     body, err := ioutil.ReadAll(r.Body)
@@ -77,17 +89,18 @@ func spinnerNotifyChannel(c chan chanMessage) {
       log.Println(err)
       return
     }
-    // get the notice from started spinner
-    c <- res
-    // notify -> stop the server
-    qs <- 0
+    // get the notice from started spinner, if still waited on
+    select {
+    case c <- res:
+    case <- done:
+    }
   })
   //log.Fatal(s.ListenAndServe())
   s.ListenAndServe()
 }
 
-// shut down the server after message received
-func quitServer(qs chan int, s *http.Server) {
+// shut down the server once the notice is no longer waited on
+func quitServer(qs chan interface{}, s *http.Server) {
   <- qs
   time.Sleep(1*time.Second)
   log.Println("Shutting down spinner channel...")
@@ -17,7 +17,8 @@ func (c *Captain) ConnectStorage() {
     Env: []string{},
     Storage: true,
   }
-  c.state.VolumeCreate("cargo")
-  storageconfig.AddMount("cargo")
+  c.state.VolumeCreate(dockercntrl.CARGO_VOLUME)
+  storageconfig.AddMount(dockercntrl.CARGO_VOLUME)
+  storageconfig.SetSystem()
   go c.ExecuteConfig(storageconfig, nil)
 }
@@ -0,0 +1,193 @@
+package captain
+
+import (
+  "github.com/armadanet/captain/dockercntrl"
+  "github.com/google/uuid"
+  "log"
+  "sync"
+  "time"
+)
+
+// States a task moves through while the captain runs it.
+const (
+  TaskPulling   = "pulling"
+  TaskCreated   = "created"
+  TaskRunning   = "running"
+  TaskExited    = "exited"
+  TaskFailed    = "failed"
+  TaskTimedOut  = "timed_out"
+)
+
+// Task is the captain's record of a task it has been sent,
+// keyed by the task's nebula_id.
+type Task struct {
+  Id          uuid.UUID   `json:"nebula_id"`
+  ContainerID string      `json:"container_id,omitempty"`
+  State       string      `json:"state"`
+  Started     time.Time   `json:"started"`
+  Finished    time.Time   `json:"finished"`
+  ExitCode    int64       `json:"exit_code"`
+  Ports       []*dockercntrl.PortBinding `json:"ports,omitempty"`
+  Restarts    int         `json:"restarts,omitempty"`
+  Health      string      `json:"health,omitempty"`
+}
+
+// Registry tracks every task the captain is or has been running.
+// It is safe for concurrent use. Configs without an id, such as the
+// captain's own system containers, are never tracked.
+type Registry struct {
+  mu      sync.RWMutex
+  tasks   map[uuid.UUID]*Task
+}
+
+// Construct a new, empty registry
+func NewRegistry() *Registry {
+  return &Registry{tasks: make(map[uuid.UUID]*Task)}
+}
+
+// Begins tracking a task as pulling its image. Returns false, leaving
+// the registry untouched, if a task with the same id is already
+// tracked. Configs without an id are always accepted.
+func (r *Registry) Add(id *uuid.UUID) bool {
+  if id == nil {return true}
+  r.mu.Lock()
+  defer r.mu.Unlock()
+  if _, ok := r.tasks[*id]; ok {return false}
+  r.tasks[*id] = &Task{Id: *id, State: TaskPulling}
+  return true
+}
+
+// Records the container built for a task.
+func (r *Registry) Created(id *uuid.UUID, containerID string) {
+  r.update(id, func(t *Task) {
+    t.ContainerID = containerID
+    t.State = TaskCreated
+  })
+}
+
+// Records that a task's container has started.
+func (r *Registry) Running(id *uuid.UUID) {
+  r.update(id, func(t *Task) {
+    t.State = TaskRunning
+    t.Started = time.Now()
+  })
+}
+
+// Records the host ports a task's container was published on.
+func (r *Registry) Published(id *uuid.UUID, ports []*dockercntrl.PortBinding) {
+  r.update(id, func(t *Task) {
+    t.Ports = ports
+  })
+}
+
+// Records that a service's container has been restarted.
+func (r *Registry) Restarted(id *uuid.UUID) {
+  r.update(id, func(t *Task) {
+    t.Restarts++
+  })
+}
+
+// Records the health last reported for a service.
+func (r *Registry) Health(id *uuid.UUID, health string) {
+  r.update(id, func(t *Task) {
+    t.Health = health
+  })
+}
+
+// Records that a task has ended, either exited or failed.
+func (r *Registry) Finish(id *uuid.UUID, state string, exitCode int64) {
+  r.update(id, func(t *Task) {
+    t.State = state
+    t.ExitCode = exitCode
+    t.Finished = time.Now()
+  })
+}
+
+// Deletes a task from the registry.
+func (r *Registry) Delete(id *uuid.UUID) {
+  if id == nil {return}
+  r.mu.Lock()
+  defer r.mu.Unlock()
+  delete(r.tasks, *id)
+}
+
+func (r *Registry) update(id *uuid.UUID, change func(*Task)) {
+  if id == nil {return}
+  r.mu.Lock()
+  defer r.mu.Unlock()
+  if t, ok := r.tasks[*id]; ok {change(t)}
+}
+
+// Get returns a copy of the record of a task.
+func (r *Registry) Get(id *uuid.UUID) (Task, bool) {
+  if id == nil {return Task{}, false}
+  r.mu.RLock()
+  defer r.mu.RUnlock()
+  t, ok := r.tasks[*id]
+  if !ok {return Task{}, false}
+  return *t, true
+}
+
+// List returns a copy of every task record.
+func (r *Registry) List() []Task {
+  r.mu.RLock()
+  defer r.mu.RUnlock()
+  tasks := make([]Task, 0, len(r.tasks))
+  for _, t := range r.tasks {
+    tasks = append(tasks, *t)
+  }
+  return tasks
+}
+
+// Reconcile records the task containers already known to the runtime,
+// such as those left by a previous captain. Containers are matched to
+// tasks by the nebula-id label written when they were created; system
+// containers, which carry no task id, and tasks already tracked are
+// skipped. Nothing would follow a container still running, or hold
+// room for it, so it is stopped and recorded as exited. Containers
+// that cannot be inspected are skipped.
+func (r *Registry) Reconcile(state dockercntrl.Runtime) error {
+  containers, err := state.List()
+  if err != nil {return err}
+  for _, container := range containers {
+    id, err := uuid.Parse(container.Labels[dockercntrl.LABEL])
+    if err != nil {continue}
+    if _, tracked := r.Get(&id); tracked {continue}
+    task := &Task{Id: id, ContainerID: container.ID, State: TaskCreated}
+    inspection, err := state.Inspect(container)
+    if err != nil {
+      log.Println(err)
+      continue
+    }
+    if inspection.Running || inspection.Restarting {
+      log.Println("Stopping container left running:", container.ID)
+      if inspection, err = stopLeft(state, container); err != nil {
+        log.Println(err)
+        continue
+      }
+      container.Status = "exited"
+    }
+    task.Started = inspection.StartedAt
+    if inspection.Running {
+      task.State = TaskRunning
+    } else if container.Status == "exited" {
+      task.State = TaskExited
+      task.Finished = inspection.FinishedAt
+      task.ExitCode = inspection.ExitCode
+    }
+    r.mu.Lock()
+    r.tasks[id] = task
+    r.mu.Unlock()
+  }
+  return nil
+}
+
+// Stops a container left running, killing it if it will not stop, and
+// inspects it again once it has.
+func stopLeft(state dockercntrl.Runtime, container *dockercntrl.Container) (*dockercntrl.Inspection, error) {
+  if err := state.Stop(container); err != nil {
+    log.Println(err)
+    if err := state.Kill(container); err != nil {return nil, err}
+  }
+  return state.Inspect(container)
+}